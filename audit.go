@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const auditFile = "audit.log"
+
+// auditRecord is one line of the audit log. Hash covers the record with an
+// empty Hash field and PrevHash links it to the record before it, so any
+// edit, removal or reordering breaks the chain.
+type auditRecord struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Account   string    `json:"account"`
+	Action    string    `json:"action"`
+	LocalPath string    `json:"localPath,omitempty"`
+	DriveID   string    `json:"driveId,omitempty"`
+	MD5       string    `json:"md5,omitempty"`
+	Result    string    `json:"result"`
+	PrevHash  string    `json:"prevHash"`
+	Hash      string    `json:"hash"`
+}
+
+// auditLog is an append-only, hash chained JSON lines log of Drive
+// mutations, rotated to numbered files once it grows beyond maxSize.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	account  string
+	maxSize  int64
+	file     *os.File
+	size     int64
+	seq      int64
+	lastHash string
+}
+
+// unknownAccount is recorded when the Drive account could not be determined.
+const unknownAccount = "unknown"
+
+// audit is the audit log of this process. Recording on a nil log is a no-op.
+var audit *auditLog
+
+// openAuditLog opens the audit log for appending and picks up the chain
+// where the previous process left it.
+func openAuditLog(path, account string) (*auditLog, error) {
+	a := &auditLog{
+		path:    path,
+		account: account,
+		maxSize: int64(envInt("GDRIVESYNC_AUDIT_MAX_SIZE", 10<<20)),
+	}
+
+	files, err := auditFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0 && a.lastHash == ""; i-- {
+		last, err := lastAuditRecord(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			a.seq = last.Seq
+			a.lastHash = last.Hash
+		}
+	}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// record appends a mutation and its outcome to the log.
+func (a *auditLog) record(action, localPath, driveID, md5 string, result error) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec := auditRecord{
+		Seq:       a.seq + 1,
+		Time:      time.Now().UTC(),
+		Account:   a.account,
+		Action:    action,
+		LocalPath: localPath,
+		DriveID:   driveID,
+		MD5:       md5,
+		Result:    "ok",
+		PrevHash:  a.lastHash,
+	}
+	if result != nil {
+		rec.Result = result.Error()
+	}
+	rec.Hash = auditHash(rec)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Unable to write audit record: %v\n", err)
+		return
+	}
+	data = append(data, '\n')
+
+	if a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("Unable to rotate audit log: %v\n", err)
+		}
+	}
+	if _, err := a.file.Write(data); err != nil {
+		log.Printf("Unable to write audit record: %v\n", err)
+		return
+	}
+	a.file.Sync()
+	a.size += int64(len(data))
+	a.seq = rec.Seq
+	a.lastHash = rec.Hash
+}
+
+// rotate moves the current log to the file numbered one higher than the
+// newest rotated log, so gaps left by missing files are never filled in.
+func (a *auditLog) rotate() error {
+	files, err := auditFiles(a.path)
+	if err != nil {
+		return err
+	}
+	next := 1
+	for _, name := range files {
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, a.path+".")); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	rotated := a.path + "." + strconv.Itoa(next)
+	if _, err := os.Lstat(rotated); !os.IsNotExist(err) {
+		return fmt.Errorf("%s already exists", rotated)
+	}
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(a.path, rotated); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// auditHash computes the hash of a record with its Hash field cleared.
+func auditHash(rec auditRecord) string {
+	rec.Hash = ""
+	data, _ := json.Marshal(rec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditFiles returns the rotated logs oldest first followed by the current
+// log, if present.
+func auditFiles(path string) ([]string, error) {
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	type numbered struct {
+		n    int
+		name string
+	}
+	var files []numbered
+	for _, name := range rotated {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, path+"."))
+		if err == nil {
+			files = append(files, numbered{n, name})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].n < files[j].n })
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	if _, err := os.Stat(path); err == nil {
+		names = append(names, path)
+	}
+	return names, nil
+}
+
+// lastAuditRecord returns the final record of a log file, or nil if empty.
+func lastAuditRecord(name string) (*auditRecord, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var last *auditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		rec := &auditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		last = rec
+	}
+	return last, scanner.Err()
+}
+
+// verifyAuditLog checks the hash chain across all rotated files and returns
+// the number of records verified.
+func verifyAuditLog(path string) (int, error) {
+	files, err := auditFiles(path)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var prev *auditRecord
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return count, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			var rec auditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				file.Close()
+				return count, fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+			if rec.Hash != auditHash(rec) {
+				file.Close()
+				return count, fmt.Errorf("%s:%d: record %d was modified", name, line, rec.Seq)
+			}
+			if prev == nil && (rec.Seq != 1 || rec.PrevHash != "") {
+				file.Close()
+				return count, fmt.Errorf("%s:%d: log starts at record %d instead of 1", name, line, rec.Seq)
+			}
+			if prev != nil && (rec.PrevHash != prev.Hash || rec.Seq != prev.Seq+1) {
+				file.Close()
+				return count, fmt.Errorf("%s:%d: chain broken between records %d and %d", name, line, prev.Seq, rec.Seq)
+			}
+			prev = &rec
+			count++
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// driveAccount returns the email address of the authorized user.
+func driveAccount(service *drive.Service) string {
+	about, err := service.About.Get().Fields("user(emailAddress)").Do()
+	if err != nil || about.User == nil {
+		log.Printf("Unable to determine Drive account: %v\n", err)
+		return unknownAccount
+	}
+	return about.User.EmailAddress
+}
+
+// runAudit implements the audit subcommands.
+func runAudit(args []string) {
+	if len(args) == 0 || args[0] != "verify" {
+		log.Fatal("Usage: gdrivesync audit verify")
+	}
+	count, err := verifyAuditLog(auditFile)
+	if err != nil {
+		log.Fatalf("Audit log verification failed after %d records: %v", count, err)
+	}
+	fmt.Printf("Audit log intact, %d records verified.\n", count)
+}
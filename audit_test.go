@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeAuditLog records n mutations in a new audit log at path.
+func writeAuditLog(t *testing.T, path string, n int) {
+	t.Helper()
+	a, err := openAuditLog(path, "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		var result error
+		if i%2 == 1 {
+			result = errors.New("failed")
+		}
+		a.record(actionCreate, "file"+string(rune('a'+i)), "id", "md5", result)
+	}
+	a.file.Close()
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper edits the lines of the log
+		tamper    func(lines []string) []string
+		wantCount int
+		wantErr   string
+	}{
+		{"intact", func(lines []string) []string { return lines }, 5, ""},
+		{"modified record", func(lines []string) []string {
+			lines[2] = strings.Replace(lines[2], `"action":"create"`, `"action":"trash"`, 1)
+			return lines
+		}, 2, "record 3 was modified"},
+		{"removed record", func(lines []string) []string {
+			return append(lines[:2:2], lines[3:]...)
+		}, 2, "chain broken between records 2 and 4"},
+		{"reordered records", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 1, "chain broken between records 1 and 3"},
+		{"removed first record", func(lines []string) []string {
+			return lines[1:]
+		}, 0, "log starts at record 2 instead of 1"},
+		{"corrupt line", func(lines []string) []string {
+			lines[4] = "{"
+			return lines
+		}, 4, "audit.log:5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			writeAuditLog(t, path, 5)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := tt.tamper(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+			if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			count, err := verifyAuditLog(path)
+			if count != tt.wantCount {
+				t.Errorf("verified %d records, want %d", count, tt.wantCount)
+			}
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuditLogChainsAcrossFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize string
+		runs    []int // records written by each process
+	}{
+		{"single run", "", []int{3}},
+		{"reopened", "", []int{2, 3}},
+		{"rotated", "200", []int{6}},
+		{"rotated and reopened", "200", []int{3, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GDRIVESYNC_AUDIT_MAX_SIZE", tt.maxSize)
+			path := filepath.Join(t.TempDir(), "audit.log")
+			total := 0
+			for _, n := range tt.runs {
+				writeAuditLog(t, path, n)
+				total += n
+			}
+			if tt.maxSize != "" {
+				if files, _ := auditFiles(path); len(files) < 2 {
+					t.Errorf("log was not rotated: %v", files)
+				}
+			}
+			count, err := verifyAuditLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != total {
+				t.Errorf("verified %d records, want %d", count, total)
+			}
+		})
+	}
+}
+
+func TestAuditLogRotatesPastMissingFile(t *testing.T) {
+	t.Setenv("GDRIVESYNC_AUDIT_MAX_SIZE", "200")
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditLog(t, path, 6)
+	files, err := auditFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Fatalf("want at least two rotated logs, got %v", files)
+	}
+	newest := files[len(files)-2]
+	kept, err := os.ReadFile(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeAuditLog(t, path, 6)
+	if data, err := os.ReadFile(newest); err != nil || string(data) != string(kept) {
+		t.Errorf("%s overwritten by rotation: %v", newest, err)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("rotation reused the missing audit.log.1: %v", err)
+	}
+	if _, err := verifyAuditLog(path); err == nil || !strings.Contains(err.Error(), "instead of 1") {
+		t.Errorf("verifyAuditLog() = %v, want an error about the missing start", err)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const syncPairsFile = "pairs.json"
+
+// remoteObject is a file or folder stored on a backend. Backends leave the
+// fields they have no notion of empty; only Drive has folders, revisions,
+// shortcuts, extended attributes and organization metadata.
+type remoteObject struct {
+	ID      string
+	MD5     string
+	Size    int64
+	ModTime time.Time
+	// RevisionID identifies the content on backends that keep revisions.
+	RevisionID string
+	Folder     bool
+	// Shortcut is the ID of the item a Drive shortcut kept as a link points
+	// to; ViaShortcut marks objects reached by resolving a shortcut.
+	Shortcut    string
+	ViaShortcut bool
+	// Xattrs are the extended attributes stored with the object.
+	Xattrs map[string]string
+	// Meta is the metadata kept in sidecar files, nil on backends that
+	// cannot store it.
+	Meta *fileMetadata
+}
+
+// backend is a remote store a local folder can be synced with. Paths are
+// slash separated and relative to the root of the backend.
+type backend interface {
+	// String describes the backend in messages.
+	String() string
+	// list returns every object below the root keyed by relative path.
+	list() (map[string]remoteObject, error)
+	// mkdirs creates the folders files are about to be uploaded into.
+	mkdirs(dirs []string) error
+	// upload stores a local file at rel unless the object there already
+	// has the same content.
+	upload(localPath, rel string) (remoteObject, error)
+	// setMetadata gives an uploaded object the sidecar metadata of
+	// localPath. Backends that cannot store metadata ignore it.
+	setMetadata(localPath string, obj remoteObject, meta fileMetadata) error
+	// flush sends the updates deferred during a sync and returns how many
+	// of them failed.
+	flush() int
+	// download writes a listed object to localPath.
+	download(obj remoteObject, localPath string) error
+	// openRevision reads an earlier revision of a listed object.
+	openRevision(obj remoteObject, revisionID string) (io.ReadCloser, error)
+	// remove deletes the object at rel.
+	remove(rel string) error
+}
+
+// syncPair ties a local folder to a remote backend given as a URL:
+//
+//	drive:<folder id>      a Google Drive folder
+//	file:///path           a local or mounted directory
+//	s3://bucket/prefix     an S3 compatible bucket, see newS3Backend
+type syncPair struct {
+	Name   string `json:"name"`
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+// stateFile is where the sync state of the pair is kept.
+func (p syncPair) stateFile() string {
+	return p.dataFile(syncStateFile)
+}
+
+// checkpointFile is where an interrupted sync of the pair is checkpointed.
+func (p syncPair) checkpointFile() string {
+	return p.dataFile(checkpointFile)
+}
+
+// queueFile is where the watch command queues changes of the pair.
+func (p syncPair) queueFile() string {
+	return p.dataFile(changeQueueFile)
+}
+
+// dataFile names a file holding data of the pair: file itself for the
+// default pair and file with the pair name inserted before the extension
+// for the others, such as state-photos.json.
+func (p syncPair) dataFile(file string) string {
+	if p.Name == "" || p.Name == "default" {
+		return file
+	}
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "-" + p.Name + ext
+}
+
+// loadSyncPairs reads the sync pairs from GDRIVESYNC_PAIRS (default
+// pairs.json). Without a pairs file the built-in folder is synced with the
+// built-in Drive folder.
+func loadSyncPairs() []syncPair {
+	file := envString("GDRIVESYNC_PAIRS", syncPairsFile)
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return []syncPair{{Name: "default", Local: localFolderPath, Remote: "drive:" + gDriveFolderID}}
+	}
+	if err != nil {
+		log.Fatalf("Unable to read sync pairs: %v", err)
+	}
+	var pairs []syncPair
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		log.Fatalf("Corrupt sync pairs %s: %v", file, err)
+	}
+	names := map[string]bool{}
+	for _, p := range pairs {
+		if p.Local == "" || p.Remote == "" {
+			log.Fatalf("Sync pair %q needs both a local folder and a remote", p.Name)
+		}
+		if names[p.Name] {
+			log.Fatalf("Duplicate sync pair %q", p.Name)
+		}
+		names[p.Name] = true
+	}
+	return pairs
+}
+
+// pairFlag adds the -pair flag that selects a sync pair for commands that
+// work on a single pair.
+func pairFlag(flags *flag.FlagSet) *string {
+	return flags.String("pair", "", "sync pair to use, by name or local folder (default: the only pair)")
+}
+
+// findSyncPair returns the pair with the given name or local folder. An
+// empty key selects the only configured pair.
+func findSyncPair(key string) syncPair {
+	pairs := loadSyncPairs()
+	if key == "" {
+		if len(pairs) == 1 {
+			return pairs[0]
+		}
+		var names []string
+		for _, p := range pairs {
+			names = append(names, p.Name)
+		}
+		log.Fatalf("Several sync pairs are configured, select one with -pair: %s", strings.Join(names, ", "))
+	}
+	abs, _ := filepath.Abs(key)
+	for _, p := range pairs {
+		if p.Name == key {
+			return p
+		}
+		if local, err := filepath.Abs(p.Local); err == nil && local == abs {
+			return p
+		}
+	}
+	log.Fatalf("No sync pair named %q or syncing that folder", key)
+	return syncPair{}
+}
+
+// driveRoot returns the Drive folder ID of a pair, or an error if the pair
+// does not sync with Google Drive.
+func (p syncPair) driveRoot() (string, error) {
+	id, ok := strings.CutPrefix(p.Remote, "drive:")
+	if !ok {
+		return "", fmt.Errorf("sync pair %q does not use Google Drive", p.Name)
+	}
+	return id, nil
+}
+
+// openBackend creates the backend for a remote URL. The Drive service is
+// only authorized when a pair actually uses Drive.
+func openBackend(remote string, service func() *drive.Service) (backend, error) {
+	scheme, rest, ok := strings.Cut(remote, ":")
+	if !ok {
+		return nil, fmt.Errorf("remote %q has no scheme", remote)
+	}
+	switch scheme {
+	case "drive":
+		return &driveBackend{service: service(), rootID: rest}, nil
+	case "file":
+		return newLocalBackend(strings.TrimPrefix(rest, "//"))
+	case "s3":
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(rest, "//"), "/")
+		return newS3Backend(bucket, prefix)
+	default:
+		return nil, fmt.Errorf("unsupported remote %q", remote)
+	}
+}
+
+// driveBackend is a Google Drive folder.
+type driveBackend struct {
+	service *drive.Service
+	rootID  string
+
+	mu      sync.Mutex
+	folders map[string]string // folder IDs by path, once looked up
+}
+
+var _ backend = (*driveBackend)(nil)
+
+func (d *driveBackend) String() string { return "Google Drive" }
+
+// list returns the files, folders and shortcuts below the root. Google
+// Workspace documents have no content to download and are left out.
+func (d *driveBackend) list() (map[string]remoteObject, error) {
+	tree, err := listDriveTree(d.service, d.rootID)
+	if err != nil {
+		return nil, err
+	}
+	via := viaShortcut(tree)
+	objects := make(map[string]remoteObject, len(tree))
+	for rel, f := range tree {
+		switch {
+		case f.MimeType == shortcutMimeType && f.ShortcutDetails == nil:
+			log.Printf("Skipping shortcut %s: it has no target\n", rel)
+			continue
+		case f.MimeType != folderMimeType && f.MimeType != shortcutMimeType && strings.HasPrefix(f.MimeType, "application/vnd.google-apps."):
+			continue
+		}
+		obj := driveObject(f)
+		obj.ViaShortcut = via[rel]
+		objects[rel] = obj
+	}
+	return objects, nil
+}
+
+// driveObject describes a Drive file as a remote object.
+func driveObject(f *drive.File) remoteObject {
+	modTime, _ := time.Parse(time.RFC3339, f.ModifiedTime)
+	meta := metadataOf(f)
+	obj := remoteObject{
+		ID:         f.Id,
+		MD5:        f.Md5Checksum,
+		Size:       f.Size,
+		ModTime:    modTime,
+		RevisionID: f.HeadRevisionId,
+		Folder:     f.MimeType == folderMimeType,
+		Xattrs:     f.AppProperties,
+		Meta:       &meta,
+	}
+	if f.MimeType == shortcutMimeType && f.ShortcutDetails != nil {
+		obj.Shortcut = f.ShortcutDetails.TargetId
+	}
+	return obj
+}
+
+// mkdirs creates missing folders level by level in batches.
+func (d *driveBackend) mkdirs(dirs []string) error {
+	folders, err := ensureDriveFolders(d.service, d.rootID, dirs)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.folders = folders
+	d.mu.Unlock()
+	return nil
+}
+
+// folderID returns the ID of the folder at dir, creating it if needed.
+func (d *driveBackend) folderID(dir string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if id, ok := d.folders[dir]; ok {
+		return id, nil
+	}
+	folders, err := ensureDriveFolders(d.service, d.rootID, []string{dir})
+	if err != nil {
+		return "", err
+	}
+	d.folders = folders
+	return folders[dir], nil
+}
+
+// forgetFolders drops the folder IDs looked up so far, so folders removed
+// on Drive in the meantime are created again.
+func (d *driveBackend) forgetFolders() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.folders = nil
+}
+
+// upload creates or updates the Drive file at rel, which is named after the
+// local file, and syncs its extended attributes.
+func (d *driveBackend) upload(localPath, rel string) (remoteObject, error) {
+	parentID, err := d.folderID(path.Dir(rel))
+	if err != nil {
+		return remoteObject{}, err
+	}
+	f, err := uploadToGoogleDrive(d.service, localPath, parentID)
+	if err != nil {
+		return remoteObject{}, err
+	}
+	return driveObject(f), nil
+}
+
+// setMetadata updates the description, star and properties of a file. The
+// update is batched while a sync collects pendingMetadata.
+func (d *driveBackend) setMetadata(localPath string, obj remoteObject, meta fileMetadata) error {
+	var prev fileMetadata
+	if obj.Meta != nil {
+		prev = *obj.Meta
+	}
+	patch := metadataPatch(prev, meta)
+	if patch == nil {
+		return nil
+	}
+	undo := journalEntry{Action: actionMetadata, Path: localPath, DriveID: obj.ID, PrevMetadata: &prev}
+	if pendingMetadata.add("update-metadata", localPath, newMetadataRequest(obj.ID, patch), undo) {
+		return nil
+	}
+	_, err := d.service.Files.Update(obj.ID, patch).Fields("id").Do()
+	audit.record("update-metadata", localPath, obj.ID, "", err)
+	if err == nil {
+		journal.record(undo)
+	}
+	return err
+}
+
+func (d *driveBackend) flush() int {
+	return pendingMetadata.flush(d.service)
+}
+
+func (d *driveBackend) download(obj remoteObject, localPath string) error {
+	return downloadFromDrive(d.service, obj.ID, localPath)
+}
+
+func (d *driveBackend) openRevision(obj remoteObject, revisionID string) (io.ReadCloser, error) {
+	resp, err := d.service.Revisions.Get(obj.ID, revisionID).Download()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// remove trashes the item at rel, found by walking down from the root.
+func (d *driveBackend) remove(rel string) error {
+	id := d.rootID
+	for _, name := range strings.Split(rel, "/") {
+		f := getDriveFile(d.service, name, id)
+		if f == nil {
+			return fmt.Errorf("%s: %w", rel, os.ErrNotExist)
+		}
+		id = f.Id
+	}
+	_, err := d.service.Files.Update(id, &drive.File{Trashed: true}).Do()
+	audit.record(actionTrash, rel, id, "", err)
+	if err == nil {
+		journal.record(journalEntry{Action: actionTrash, Path: rel, DriveID: id})
+	}
+	return err
+}
+
+// stateEntry describes a remote object as synced with local content of
+// MD5 sum.
+func (o remoteObject) stateEntry(sum string) stateEntry {
+	return stateEntry{DriveID: o.ID, MD5: sum, Size: o.Size, RevisionID: o.RevisionID}
+}
+
+// upToDate reports whether obj already holds the content with MD5 sum. For
+// objects without an MD5 it compares the size recorded when rel was last
+// synced with that content.
+func upToDate(obj remoteObject, sum, rel string, state *syncState) bool {
+	if obj.MD5 != "" {
+		return obj.MD5 == sum
+	}
+	entry, ok := state.get(rel)
+	return ok && entry.MD5 == sum && entry.Size == obj.Size
+}
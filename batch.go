@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// maxBatchSize is the largest number of calls Drive accepts per batch.
+	maxBatchSize = 100
+	// batchRetries is how often failed items are resubmitted.
+	batchRetries   = 4
+	folderMimeType = "application/vnd.google-apps.folder"
+)
+
+// batchRequest is a single metadata-only Drive call sent as part of a batch.
+type batchRequest struct {
+	Method string
+	Path   string      // path below the API base, e.g. "files?fields=id"
+	Body   interface{} // encoded as JSON when non-nil
+	Result interface{} // decoded from the response when non-nil
+	Err    error       // set once the call has finally failed
+}
+
+// newCreateFolderRequest creates a folder named name inside parentID.
+func newCreateFolderRequest(name, parentID string, result *drive.File) *batchRequest {
+	return &batchRequest{
+		Method: http.MethodPost,
+		Path:   "files?fields=id,name,parents",
+		Body:   &drive.File{Name: name, Parents: []string{parentID}, MimeType: folderMimeType},
+		Result: result,
+	}
+}
+
+// newTrashRequest moves a file to or from the Drive trash.
+func newTrashRequest(fileID string, trashed bool) *batchRequest {
+	return &batchRequest{
+		Method: http.MethodPatch,
+		Path:   "files/" + url.PathEscape(fileID) + "?fields=id",
+		Body:   map[string]bool{"trashed": trashed},
+	}
+}
+
+// newDeleteRequest permanently deletes a file.
+func newDeleteRequest(fileID string) *batchRequest {
+	return &batchRequest{
+		Method: http.MethodDelete,
+		Path:   "files/" + url.PathEscape(fileID),
+	}
+}
+
+// newAppPropertiesRequest sets app properties on a file. Empty values
+// remove the property.
+func newAppPropertiesRequest(fileID string, props map[string]string) *batchRequest {
+	body := map[string]map[string]interface{}{"appProperties": {}}
+	for k, v := range props {
+		if v == "" {
+			body["appProperties"][k] = nil
+		} else {
+			body["appProperties"][k] = v
+		}
+	}
+	return &batchRequest{
+		Method: http.MethodPatch,
+		Path:   "files/" + url.PathEscape(fileID) + "?fields=id",
+		Body:   body,
+	}
+}
+
+// newMetadataRequest applies a metadata-only patch to a file.
+func newMetadataRequest(fileID string, patch *drive.File) *batchRequest {
+	return &batchRequest{
+		Method: http.MethodPatch,
+		Path:   "files/" + url.PathEscape(fileID) + "?fields=id",
+		Body:   patch,
+	}
+}
+
+// metadataBatch collects the metadata-only updates a sync finds so they go
+// out through the batch endpoint once the uploads are done.
+type metadataBatch struct {
+	mu       sync.Mutex
+	requests []*batchRequest
+	actions  []string
+	paths    []string
+	undo     []journalEntry
+}
+
+// pendingMetadata collects the metadata updates of the running sync. When
+// it is nil updates are sent one call at a time.
+var pendingMetadata *metadataBatch
+
+// add queues an update made on behalf of localPath, audited as action and
+// journaled as undo once it succeeded. It returns false if updates are not
+// batched.
+func (b *metadataBatch) add(action, localPath string, req *batchRequest, undo journalEntry) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests = append(b.requests, req)
+	b.actions = append(b.actions, action)
+	b.paths = append(b.paths, localPath)
+	b.undo = append(b.undo, undo)
+	return true
+}
+
+// flush sends the queued updates and returns how many failed.
+func (b *metadataBatch) flush(service *drive.Service) int {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.requests) == 0 {
+		return 0
+	}
+	fmt.Printf("Updating metadata of %d files on Google Drive...\n", len(b.requests))
+	runBatch(service, b.requests)
+	failed := 0
+	for i, req := range b.requests {
+		audit.record(b.actions[i], b.paths[i], b.undo[i].DriveID, "", req.Err)
+		if req.Err != nil {
+			log.Printf("Error updating metadata of %s: %v\n", b.paths[i], req.Err)
+			failed++
+			continue
+		}
+		journal.record(b.undo[i])
+	}
+	b.requests, b.actions, b.paths, b.undo = nil, nil, nil, nil
+	return failed
+}
+
+// runBatch sends requests through the Drive batch endpoint in groups of up
+// to maxBatchSize. Items that fail with rate limit or server errors are
+// resubmitted with exponential backoff; every other failure is recorded in
+// the item's Err. The returned error summarizes how many items failed.
+func runBatch(service *drive.Service, requests []*batchRequest) error {
+	pending := requests
+	delay := time.Second
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		var retry []*batchRequest
+		for start := 0; start < len(pending); start += maxBatchSize {
+			end := start + maxBatchSize
+			if end > len(pending) {
+				end = len(pending)
+			}
+			chunk := pending[start:end]
+			if err := sendBatch(service, chunk); err != nil {
+				for _, req := range chunk {
+					req.Err = err
+				}
+			}
+			for _, req := range chunk {
+				if req.Err != nil && attempt < batchRetries && isRetryable(req.Err) {
+					retry = append(retry, req)
+				}
+			}
+		}
+		pending = retry
+	}
+
+	failed := 0
+	for _, req := range requests {
+		if req.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d batched requests failed", failed, len(requests))
+	}
+	return nil
+}
+
+// sendBatch performs one multipart batch call and distributes the
+// individual responses to their requests.
+func sendBatch(service *drive.Service, requests []*batchRequest) error {
+	base, err := url.Parse(service.BasePath)
+	if err != nil {
+		return err
+	}
+	batchURL := base.Scheme + "://" + base.Host + "/batch" + strings.TrimSuffix(base.Path, "/")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, req := range requests {
+		req.Err = nil
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {"<item" + strconv.Itoa(i) + ">"},
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(part, "%s %s%s HTTP/1.1\r\n", req.Method, base.Path, req.Path)
+		if req.Body != nil {
+			payload, err := json.Marshal(req.Body)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(part, "Content-Type: application/json; charset=UTF-8\r\n\r\n%s\r\n", payload)
+		} else {
+			fmt.Fprint(part, "\r\n")
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, batchURL, &body)
+	if err != nil {
+		return err
+	}
+	// A batch counts against the quota once per item
+	if driveLimiter != nil {
+		for range requests[1:] {
+			if err := driveLimiter.wait(httpReq.Context()); err != nil {
+				return err
+			}
+		}
+	}
+	httpReq.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	resp, err := driveClient.Do(httpReq)
+	if err != nil {
+		return transportError{err}
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("unexpected batch response: %v", err)
+	}
+	answered := make([]bool, len(requests))
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		id := strings.Trim(part.Header.Get("Content-Id"), "<>")
+		i, err := strconv.Atoi(strings.TrimPrefix(id, "response-item"))
+		if err != nil || i < 0 || i >= len(requests) {
+			return fmt.Errorf("unexpected batch part %q", id)
+		}
+		answered[i] = true
+		requests[i].Err = decodeBatchPart(part, requests[i].Result)
+	}
+
+	for i, ok := range answered {
+		if !ok {
+			requests[i].Err = errors.New("missing response in batch")
+		}
+	}
+	return nil
+}
+
+// decodeBatchPart parses the HTTP response embedded in a batch part.
+func decodeBatchPart(part io.Reader, result interface{}) error {
+	resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		if isRetryable(err) && driveLimiter != nil {
+			driveLimiter.backoff()
+		}
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// transportError is a failure to get any response to a batch call.
+type transportError struct {
+	err error
+}
+
+func (e transportError) Error() string { return e.err.Error() }
+func (e transportError) Unwrap() error { return e.err }
+
+// isRetryable reports whether a failed call is worth resubmitting. Besides
+// rate limit and server errors only batches that got no response at all
+// are retried; once Drive answered, a call that cannot be decoded may
+// still have been carried out, and repeating it could create duplicates.
+func isRetryable(err error) bool {
+	if errors.As(err, new(transportError)) {
+		return true
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code >= 500 || isRateLimitError(err)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// defaultBlockSize is the size of the ranged reads of a mount.
+const defaultBlockSize = 1 << 20
+
+// mountBlockSize returns GDRIVESYNC_MOUNT_BLOCK_SIZE, falling back to
+// defaultBlockSize for sizes that are not positive.
+func mountBlockSize() int64 {
+	size := int64(envInt("GDRIVESYNC_MOUNT_BLOCK_SIZE", defaultBlockSize))
+	if size <= 0 {
+		log.Printf("Ignoring GDRIVESYNC_MOUNT_BLOCK_SIZE=%d, using %d\n", size, defaultBlockSize)
+		return defaultBlockSize
+	}
+	return size
+}
+
+// blockCache keeps fixed size blocks of remote file content on local disk
+// and evicts the least recently used blocks beyond maxSize bytes.
+type blockCache struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+}
+
+// newBlockCache opens the cache in dir, creating it if necessary.
+func newBlockCache(dir string, maxSize int64) (*blockCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &blockCache{dir: dir, maxSize: maxSize}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			c.size += info.Size()
+		}
+	}
+	return c, nil
+}
+
+func (c *blockCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// get returns a cached block and marks it as recently used.
+func (c *blockCache) get(key string) ([]byte, bool) {
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+// put stores a block, evicting old blocks if the cache is full.
+func (c *blockCache) put(key string, data []byte) {
+	path := c.path(key)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size += int64(len(data))
+	if c.size > c.maxSize {
+		c.evict()
+	}
+}
+
+// evict removes the least recently used blocks until the cache is at 90%
+// of its maximum size. It must be called with c.mu held.
+func (c *blockCache) evict() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	c.size = 0
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			infos = append(infos, info)
+			c.size += info.Size()
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+
+	target := c.maxSize / 10 * 9
+	for _, info := range infos {
+		if c.size <= target {
+			break
+		}
+		if os.Remove(filepath.Join(c.dir, info.Name())) == nil {
+			c.size -= info.Size()
+		}
+	}
+}
+
+// readBlock returns block number index of a Drive file, fetching it with
+// a ranged download on a cache miss. The cache key includes the file's
+// checksum or modification time so changed files never serve stale data.
+func readBlock(service *drive.Service, cache *blockCache, file *drive.File, index, blockSize int64) ([]byte, error) {
+	version := file.Md5Checksum
+	if version == "" {
+		version = file.ModifiedTime
+	}
+	key := fmt.Sprintf("%s:%s:%d:%d", file.Id, version, blockSize, index)
+	if data, ok := cache.get(key); ok {
+		return data, nil
+	}
+
+	start := index * blockSize
+	end := start + blockSize - 1
+	if end >= file.Size {
+		end = file.Size - 1
+	}
+	call := service.Files.Get(file.Id)
+	call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := call.Download()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.put(key, data)
+	return data, nil
+}
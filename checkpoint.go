@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	checkpointFile = "checkpoint.json"
+	// checkpointSaveInterval throttles how often progress is written out.
+	checkpointSaveInterval = 2 * time.Second
+)
+
+// checkpointItem is one planned upload and whether it has completed.
+type checkpointItem struct {
+	Name    string `json:"name"`
+	Dir     string `json:"dir,omitempty"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Done    bool   `json:"done"`
+}
+
+// checkpoint persists the plan of an in-progress sync so an interrupted run
+// can resume without walking the local folder again.
+type checkpoint struct {
+	LocalRoot  string            `json:"localRoot"`
+	RemoteRoot string            `json:"remoteRoot"`
+	Created    time.Time         `json:"created"`
+	Items      []*checkpointItem `json:"items"`
+
+	mu       sync.Mutex
+	file     string
+	index    map[string]*checkpointItem
+	lastSave time.Time
+}
+
+// loadCheckpoint reads the checkpoint left behind by an interrupted run.
+// It returns nil if there is none, if it belongs to a different pair of
+// folders or if it is older than GDRIVESYNC_CHECKPOINT_MAX_AGE (default 24h).
+func loadCheckpoint(file, localRoot, remoteRoot string) *checkpoint {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	cp := &checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		log.Printf("Ignoring corrupt checkpoint: %v\n", err)
+		return nil
+	}
+	if cp.LocalRoot != localRoot || cp.RemoteRoot != remoteRoot {
+		return nil
+	}
+	if time.Since(cp.Created) > envDuration("GDRIVESYNC_CHECKPOINT_MAX_AGE", 24*time.Hour) {
+		log.Printf("Discarding checkpoint from %s\n", cp.Created.Format(time.RFC3339))
+		return nil
+	}
+	cp.file = file
+	cp.buildIndex()
+	return cp
+}
+
+// newCheckpoint records the plan for syncing files.
+func newCheckpoint(file, localRoot, remoteRoot string, files []File) *checkpoint {
+	cp := &checkpoint{
+		LocalRoot:  localRoot,
+		RemoteRoot: remoteRoot,
+		Created:    time.Now(),
+		file:       file,
+	}
+	for _, f := range files {
+		cp.Items = append(cp.Items, &checkpointItem{Name: f.Name, Dir: f.RemoteDir, Size: f.Size, ModTime: f.ModTime.UnixNano()})
+	}
+	cp.buildIndex()
+	return cp
+}
+
+func (cp *checkpoint) buildIndex() {
+	cp.index = make(map[string]*checkpointItem, len(cp.Items))
+	for _, item := range cp.Items {
+		cp.index[item.Name] = item
+	}
+}
+
+// pending returns the files that still need syncing. Completed items whose
+// file changed since the checkpoint was written are invalidated and
+// returned again; items whose file disappeared are dropped.
+func (cp *checkpoint) pending() []File {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	var files []File
+	kept := cp.Items[:0]
+	for _, item := range cp.Items {
+		path := filepath.Join(cp.LocalRoot, item.Name)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.Size() != item.Size || info.ModTime().UnixNano() != item.ModTime {
+			item.Size = info.Size()
+			item.ModTime = info.ModTime().UnixNano()
+			item.Done = false
+		}
+		kept = append(kept, item)
+		if !item.Done {
+			files = append(files, File{Name: item.Name, Path: path, RemoteDir: item.Dir})
+		}
+	}
+	cp.Items = kept
+	cp.buildIndex()
+	return files
+}
+
+// markDone records that a file was synced and periodically saves progress.
+func (cp *checkpoint) markDone(name string) {
+	cp.mu.Lock()
+	if item, ok := cp.index[name]; ok {
+		item.Done = true
+	}
+	due := time.Since(cp.lastSave) >= checkpointSaveInterval
+	cp.mu.Unlock()
+
+	if due {
+		if err := cp.save(); err != nil {
+			log.Printf("Unable to save checkpoint: %v\n", err)
+		}
+	}
+}
+
+// save writes the checkpoint to disk.
+func (cp *checkpoint) save() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := cp.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	cp.lastSave = time.Now()
+	return os.Rename(tmp, cp.file)
+}
+
+// remove deletes the checkpoint after a fully successful run.
+func (cp *checkpoint) remove() error {
+	err := os.Remove(cp.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxMergeSize is the largest file offered for a three-way merge or shown
+// as a diff.
+const maxMergeSize = 4 << 20
+
+// maxDiffLines is how much of a diff is shown for a conflict.
+const maxDiffLines = 200
+
+// conflict is a local file with changes a pull would replace by Object.
+type conflict struct {
+	Rel    string
+	Object remoteObject
+}
+
+// conflictQueue collects conflicts found by pull workers so they can be
+// resolved one at a time once the workers are done.
+type conflictQueue struct {
+	mu    sync.Mutex
+	items []conflict
+}
+
+// conflicts is the conflict queue of an interactive pull. When it is nil
+// conflicting local files are moved to the local trash.
+var conflicts *conflictQueue
+
+// add queues a conflict. It returns false if conflicts are not resolved
+// interactively.
+func (q *conflictQueue) add(c conflict) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, c)
+	return true
+}
+
+// resolveConflicts asks how to resolve each queued conflict and applies the
+// answer. It returns the number of conflicts that could not be resolved.
+func resolveConflicts(b backend, root string, state *syncState) int {
+	if conflicts == nil {
+		return 0
+	}
+	items := conflicts.items
+	conflicts.items = nil
+	sort.Slice(items, func(i, j int) bool { return items[i].Rel < items[j].Rel })
+
+	failed := 0
+	in := bufio.NewReader(os.Stdin)
+	for n, c := range items {
+		fmt.Printf("\nConflict %d of %d: %s\n", n+1, len(items), c.Rel)
+		if err := resolveConflict(b, root, c, state, in); err != nil {
+			log.Printf("Error resolving %s: %v\n", c.Rel, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// resolveConflict shows one conflict and applies the chosen resolution.
+func resolveConflict(b backend, root string, c conflict, state *syncState, in *bufio.Reader) error {
+	localPath := filepath.Join(root, filepath.FromSlash(c.Rel))
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  local:  %d bytes, modified %s\n", info.Size(), info.ModTime().Format(time.RFC3339))
+	fmt.Printf("  remote: %d bytes, modified %s\n", c.Object.Size, c.Object.ModTime.Format(time.RFC3339))
+
+	// Text files small enough to merge are shown as a diff
+	text := false
+	if info.Size() <= maxMergeSize && c.Object.Size <= maxMergeSize {
+		if data, err := os.ReadFile(localPath); err == nil && isText(data) {
+			text = true
+			showDiff(b, c, data)
+		}
+	}
+
+	// A merge needs the version both sides started from, which only
+	// backends with revisions keep
+	entry, synced := state.get(c.Rel)
+	canMerge := text && synced && entry.RevisionID != "" && entry.DriveID == c.Object.ID
+
+	options := "[l]ocal, [r]emote, [b]oth"
+	if canMerge {
+		options += ", [m]erge"
+	}
+	for {
+		fmt.Printf("Keep %s or [s]kip? ", options)
+		answer, err := in.ReadString('\n')
+		if err != nil && answer == "" {
+			return fmt.Errorf("no answer: %v", err)
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "l", "local":
+			// The local version is uploaded by the next sync
+			fmt.Printf("Keeping local %s.\n", c.Rel)
+			return nil
+		case "r", "remote":
+			if err := moveToLocalTrash(root, state.trashStamp(), filepath.FromSlash(c.Rel)); err != nil {
+				return err
+			}
+			return fetchObject(b, root, c.Rel, c.Object, state)
+		case "b", "both":
+			ext := filepath.Ext(localPath)
+			kept := strings.TrimSuffix(localPath, ext) + " (local conflict " + time.Now().Format("2006-01-02 150405") + ")" + ext
+			fmt.Printf("Keeping local version as %s.\n", filepath.Base(kept))
+			if err := os.Rename(localPath, kept); err != nil {
+				return err
+			}
+			return fetchObject(b, root, c.Rel, c.Object, state)
+		case "m", "merge":
+			if canMerge {
+				return mergeConflict(b, root, c, entry, state)
+			}
+		case "s", "skip":
+			return nil
+		}
+	}
+}
+
+// showDiff prints how the remote version of a text file differs from the
+// local content.
+func showDiff(b backend, c conflict, local []byte) {
+	remote, err := remoteContent(b, c)
+	if err != nil {
+		log.Printf("Unable to fetch remote %s for a diff: %v\n", c.Rel, err)
+		return
+	}
+	if len(remote) > maxMergeSize || !isText(remote) {
+		fmt.Println("  remote version is not text")
+		return
+	}
+	diff, ok := diffLines(string(local), string(remote))
+	if !ok {
+		fmt.Println("  changes are too large to show")
+		return
+	}
+	lines := splitLines(diff)
+	fmt.Println("  changes from local to remote:")
+	for _, line := range lines[:min(len(lines), maxDiffLines)] {
+		fmt.Print("    " + line)
+	}
+	if len(lines) > maxDiffLines {
+		fmt.Printf("    ... %d more lines\n", len(lines)-maxDiffLines)
+	}
+}
+
+// remoteContent reads the remote version of a conflict, up to one byte
+// more than maxMergeSize.
+func remoteContent(b backend, c conflict) ([]byte, error) {
+	tmp, err := os.CreateTemp("", "gdrivesync-conflict-*")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := b.download(c.Object, tmp.Name()); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, maxMergeSize+1))
+}
+
+// mergeConflict merges local and remote changes on top of the revision
+// recorded at the last sync and writes the result to the local file. The
+// remote version becomes the new base, so the next sync uploads the merge.
+func mergeConflict(b backend, root string, c conflict, base stateEntry, state *syncState) error {
+	localPath := filepath.Join(root, filepath.FromSlash(c.Rel))
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxMergeSize {
+		return fmt.Errorf("local version is too large to merge")
+	}
+	ours, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	body, err := b.openRevision(c.Object, base.RevisionID)
+	if err != nil {
+		return fmt.Errorf("fetching base revision: %v", err)
+	}
+	baseData, err := io.ReadAll(io.LimitReader(body, maxMergeSize+1))
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("fetching base revision: %v", err)
+	}
+	if len(baseData) > maxMergeSize {
+		return fmt.Errorf("base revision is too large to merge")
+	}
+	theirs, err := remoteContent(b, c)
+	if err != nil {
+		return err
+	}
+	if len(theirs) > maxMergeSize {
+		return fmt.Errorf("remote version is too large to merge")
+	}
+	if !isText(baseData) || !isText(theirs) {
+		return fmt.Errorf("remote version is not text")
+	}
+
+	merged, conflicted, ok := merge3(string(baseData), string(ours), string(theirs))
+	if !ok {
+		return fmt.Errorf("changes are too large to merge")
+	}
+	if err := os.WriteFile(localPath, []byte(merged), info.Mode().Perm()); err != nil {
+		return err
+	}
+	state.set(c.Rel, c.Object.stateEntry(c.Object.MD5))
+	if conflicted {
+		fmt.Printf("Merged %s with conflicts; edit the marked regions before the next sync.\n", c.Rel)
+	} else {
+		fmt.Printf("Merged %s cleanly.\n", c.Rel)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileChangeTime returns the modification time where the inode change
+// time is not available.
+func fileChangeTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
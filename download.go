@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// downloadFromDrive downloads a Drive file to localPath. The content is
+// written to a temporary file first so an interrupted download never
+// leaves a truncated file behind.
+func downloadFromDrive(service *drive.Service, fileID, localPath string) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+
+	resp, err := service.Files.Get(fileID).Download()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(localPath), ".gdrivesync-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), localPath)
+}
+
+// downloadDriveTree downloads a Drive file, or a folder with everything in
+// it, to localPath.
+func downloadDriveTree(service *drive.Service, file *drive.File, localPath string) error {
+	if file.MimeType != folderMimeType {
+		if strings.HasPrefix(file.MimeType, "application/vnd.google-apps.") {
+			fmt.Printf("Skipping %s: Google Workspace documents cannot be downloaded.\n", file.Name)
+			return nil
+		}
+		fmt.Printf("Downloading %s...\n", localPath)
+		return downloadFromDrive(service, file.Id, localPath)
+	}
+
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("'%s' in parents", file.Id)
+	pageToken := ""
+	for {
+		list, err := service.Files.List().Q(query).Fields("nextPageToken, files(id, name, mimeType)").PageToken(pageToken).PageSize(1000).Do()
+		if err != nil {
+			return err
+		}
+		for _, child := range list.Files {
+			if err := downloadDriveTree(service, child, filepath.Join(localPath, safeLocalName(child.Name))); err != nil {
+				return err
+			}
+		}
+		if list.NextPageToken == "" {
+			return nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+// safeLocalName turns a Drive file name into a single local path element.
+// Drive allows slashes and names like ".." that must not escape the target.
+func safeLocalName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
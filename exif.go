@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// EXIF tags holding the time a photo was taken.
+const (
+	exifIFDPointerTag   = 0x8769
+	exifDateTimeTag     = 0x0132
+	exifDateOriginalTag = 0x9003
+)
+
+// exifDate returns the date a JPEG photo was taken from its EXIF data,
+// preferring DateTimeOriginal over DateTime.
+func exifDate(localPath string) (time.Time, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+	tiff, err := jpegExifSegment(bufio.NewReader(file))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(tiff, []byte("II*\x00")):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(tiff, []byte("MM\x00*")):
+		order = binary.BigEndian
+	default:
+		return time.Time{}, fmt.Errorf("invalid TIFF header")
+	}
+
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	value := ifd0[exifDateTimeTag]
+	if ptr, ok := ifd0[exifIFDPointerTag]; ok && len(ptr) == 4 {
+		if original, ok := readIFD(tiff, order, order.Uint32(ptr))[exifDateOriginalTag]; ok {
+			value = original
+		}
+	}
+	if len(value) < 19 {
+		return time.Time{}, fmt.Errorf("no EXIF date")
+	}
+	return time.ParseInLocation("2006:01:02 15:04:05", string(value[:19]), time.Local)
+}
+
+// jpegExifSegment returns the TIFF data of the EXIF APP1 segment of a JPEG.
+func jpegExifSegment(r io.Reader) ([]byte, error) {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		if header[0] != 0xFF || header[1] == 0xDA {
+			// Image data starts without an EXIF segment
+			return nil, fmt.Errorf("no EXIF data")
+		}
+		size := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if size < 0 {
+			return nil, fmt.Errorf("invalid JPEG segment")
+		}
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+		if header[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) && len(segment) >= 14 {
+			return segment[6:], nil
+		}
+	}
+}
+
+// readIFD returns the ASCII and LONG values of a TIFF image file directory
+// keyed by tag. Other types and out of range entries are skipped.
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16][]byte {
+	values := map[uint16][]byte{}
+	if int(offset)+2 > len(tiff) {
+		return values
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := int(offset) + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		tag := order.Uint16(tiff[entry:])
+		typ := order.Uint16(tiff[entry+2:])
+		n := int(order.Uint32(tiff[entry+4:]))
+		switch {
+		case typ == 2 && n > 4: // ASCII stored at an offset
+			start := int(order.Uint32(tiff[entry+8:]))
+			if start >= 0 && n <= len(tiff) && start <= len(tiff)-n {
+				values[tag] = tiff[start : start+n]
+			}
+		case typ == 2 || typ == 4: // short ASCII or LONG stored inline
+			values[tag] = tiff[entry+8 : entry+12]
+		}
+	}
+	return values
+}
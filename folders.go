@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// listDriveFolders returns the IDs of all folders below rootID keyed by
+// their slash separated path relative to rootID. The root itself is ".".
+func listDriveFolders(service *drive.Service, rootID string) (map[string]string, error) {
+	folders := map[string]string{".": rootID}
+	queue := []string{"."}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		query := fmt.Sprintf("'%s' in parents and mimeType='%s' and trashed=false", folders[dir], folderMimeType)
+		pageToken := ""
+		for {
+			list, err := service.Files.List().Q(query).Fields("nextPageToken, files(id, name)").PageToken(pageToken).PageSize(1000).Do()
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range list.Files {
+				rel := path.Join(dir, f.Name)
+				if _, ok := folders[rel]; ok {
+					continue
+				}
+				folders[rel] = f.Id
+				queue = append(queue, rel)
+			}
+			if list.NextPageToken == "" {
+				break
+			}
+			pageToken = list.NextPageToken
+		}
+	}
+	return folders, nil
+}
+
+// ensureDriveFolders makes sure every directory in dirs (slash separated,
+// relative to rootID) exists on Drive, creating missing ones level by level
+// in batches. It returns the IDs of all folders keyed by relative path.
+func ensureDriveFolders(service *drive.Service, rootID string, dirs []string) (map[string]string, error) {
+	folders, err := listDriveFolders(service, rootID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect every missing directory including its ancestors
+	missing := map[string]bool{}
+	for _, dir := range dirs {
+		for d := path.Clean(dir); d != "." && d != "/"; d = path.Dir(d) {
+			if _, ok := folders[d]; !ok {
+				missing[d] = true
+			}
+		}
+	}
+
+	// Group by depth so parents are created before their children
+	levels := map[int][]string{}
+	maxDepth := 0
+	for d := range missing {
+		depth := strings.Count(d, "/")
+		levels[depth] = append(levels[depth], d)
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+
+	for depth := 0; depth <= maxDepth; depth++ {
+		names := levels[depth]
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+
+		requests := make([]*batchRequest, len(names))
+		results := make([]drive.File, len(names))
+		for i, d := range names {
+			fmt.Printf("Creating folder %s on Google Drive...\n", d)
+			requests[i] = newCreateFolderRequest(path.Base(d), folders[path.Dir(d)], &results[i])
+		}
+		err := runBatch(service, requests)
+		for i, req := range requests {
+			audit.record(actionCreate, names[i], results[i].Id, "", req.Err)
+		}
+		if err != nil {
+			for i, req := range requests {
+				if req.Err != nil {
+					return nil, fmt.Errorf("creating folder %s: %w", names[i], req.Err)
+				}
+			}
+			return nil, err
+		}
+		for i, d := range names {
+			folders[d] = results[i].Id
+			journal.record(journalEntry{Action: actionCreate, Path: d, DriveID: results[i].Id})
+		}
+	}
+	return folders, nil
+}
+
+// driveFileFields are the file fields requested when listing a tree.
+const driveFileFields = "id, name, mimeType, md5Checksum, size, modifiedTime, headRevisionId, appProperties, description, starred, properties, shortcutDetails"
+
+// listDriveTree returns every file and folder below rootID keyed by its
+// slash separated path relative to rootID. Shortcuts are skipped, resolved
+// or kept according to the shortcut policy; a folder reached through a
+// shortcut is listed only once, which stops cycles.
+func listDriveTree(service *drive.Service, rootID string) (map[string]*drive.File, error) {
+	policy := shortcutPolicy()
+	tree := map[string]*drive.File{}
+	type dirRef struct{ path, id string }
+	queue := []dirRef{{".", rootID}}
+	visited := map[string]bool{rootID: true}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		query := fmt.Sprintf("'%s' in parents and trashed=false", dir.id)
+		pageToken := ""
+		for {
+			list, err := service.Files.List().Q(query).Fields("nextPageToken, files(" + driveFileFields + ")").PageToken(pageToken).PageSize(1000).Do()
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range list.Files {
+				rel := path.Join(dir.path, safeLocalName(f.Name))
+				if _, ok := tree[rel]; ok {
+					log.Printf("Ignoring duplicate %s on Google Drive\n", rel)
+					continue
+				}
+				if f.MimeType == shortcutMimeType {
+					if policy == shortcutSkip {
+						continue
+					}
+					if policy == shortcutResolve {
+						target, err := resolveShortcut(service, f)
+						if err != nil {
+							log.Printf("Skipping shortcut %s: %v\n", rel, err)
+							continue
+						}
+						f = target
+					}
+				}
+				if f.MimeType == folderMimeType {
+					if visited[f.Id] {
+						log.Printf("Skipping %s: folder is already included\n", rel)
+						continue
+					}
+					visited[f.Id] = true
+					queue = append(queue, dirRef{rel, f.Id})
+				}
+				tree[rel] = f
+			}
+			if list.NextPageToken == "" {
+				break
+			}
+			pageToken = list.NextPageToken
+		}
+	}
+	if policy == shortcutLink {
+		placeShortcutLinks(tree)
+	}
+	return tree, nil
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// A repository on Drive is a folder holding refs.json and the bundles it
+// lists. Every push adds one bundle with the objects the remote did not
+// have yet, so fetching applies the bundles in order.
+const (
+	gitRefsFile     = "refs.json"
+	gitLockFile     = "push.lock"
+	gitRemoteHelper = "git-remote-gdrive"
+)
+
+// gitManifest is the content of refs.json.
+type gitManifest struct {
+	Head    string            `json:"head,omitempty"`
+	Refs    map[string]string `json:"refs"`
+	Bundles []gitBundle       `json:"bundles"`
+}
+
+// gitBundle is one pushed bundle stored on Drive.
+type gitBundle struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// gitRemote talks to one repository folder on Drive on behalf of git.
+type gitRemote struct {
+	service     *drive.Service
+	folderID    string
+	gitDir      string
+	cacheDir    string // remembers which bundles were applied locally
+	manifestID  string // Drive ID of refs.json, empty for an empty repository
+	manifestMD5 string // checksum of refs.json when it was loaded
+	manifest    gitManifest
+	lockID      string // Drive ID of the push lock file while it is held
+	lockTTL     time.Duration
+}
+
+// runGitRemote implements the git remote helper protocol. git runs it as
+// git-remote-gdrive <remote> <url> for URLs like gdrive://<folder ID>,
+// with commands on stdin and answers expected on stdout.
+func runGitRemote(args []string) {
+	if len(args) < 2 {
+		log.Fatalf("Usage: %s <remote> <url>", gitRemoteHelper)
+	}
+	// Everything but the protocol goes to stderr, where git shows it
+	out := bufio.NewWriter(os.Stdout)
+	os.Stdout = os.Stderr
+
+	gitDir, err := filepath.Abs(envString("GIT_DIR", ".git"))
+	if err != nil {
+		log.Fatalf("Unable to locate repository: %v", err)
+	}
+	// The token and audit log live next to the rest of the gdrivesync files
+	if dir := os.Getenv("GDRIVESYNC_DIR"); dir != "" {
+		if err := os.Chdir(dir); err != nil {
+			log.Fatalf("Unable to change to %s: %v", dir, err)
+		}
+	}
+
+	url := strings.TrimPrefix(strings.TrimPrefix(args[1], "gdrive::"), "gdrive://")
+	r := &gitRemote{
+		service:  newDriveService(),
+		folderID: strings.Trim(url, "/"),
+		gitDir:   gitDir,
+		cacheDir: filepath.Join(gitDir, "gdrive", safeLocalName(args[0])),
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	for in.Scan() {
+		line := in.Text()
+		switch {
+		case line == "":
+			return
+		case line == "capabilities":
+			fmt.Fprint(out, "fetch\npush\n\n")
+		case line == "list" || line == "list for-push":
+			if err := r.list(out); err != nil {
+				log.Fatalf("Unable to list refs: %v", err)
+			}
+		case strings.HasPrefix(line, "fetch "):
+			// Fetches come in a batch ended by a blank line
+			for in.Scan() && in.Text() != "" {
+			}
+			if err := r.fetch(); err != nil {
+				log.Fatalf("Unable to fetch: %v", err)
+			}
+			fmt.Fprint(out, "\n")
+		case strings.HasPrefix(line, "push "):
+			specs := []string{strings.TrimPrefix(line, "push ")}
+			for in.Scan() && in.Text() != "" {
+				specs = append(specs, strings.TrimPrefix(in.Text(), "push "))
+			}
+			r.push(specs, out)
+			fmt.Fprint(out, "\n")
+		default:
+			log.Fatalf("Unsupported command %q", line)
+		}
+		if err := out.Flush(); err != nil {
+			log.Fatalf("Unable to answer git: %v", err)
+		}
+	}
+}
+
+// git runs a git command against the local repository and returns its
+// output.
+func (r *gitRemote) git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_DIR="+r.gitDir)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// hasObject reports whether the local repository contains an object.
+func (r *gitRemote) hasObject(sha string) bool {
+	_, err := r.git("cat-file", "-e", sha)
+	return err == nil
+}
+
+// findFile returns the file with the given name in the repository folder,
+// or nil if there is none.
+func (r *gitRemote) findFile(name string) (*drive.File, error) {
+	query := fmt.Sprintf("name=%s and '%s' in parents and trashed=false", driveQueryString(name), r.folderID)
+	list, err := r.service.Files.List().Q(query).Fields("files(id, name, md5Checksum)").PageSize(1).Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Files) == 0 {
+		return nil, nil
+	}
+	return list.Files[0], nil
+}
+
+// loadManifest reads refs.json from Drive. A missing file is an empty
+// repository.
+func (r *gitRemote) loadManifest() error {
+	r.manifestID, r.manifestMD5 = "", ""
+	r.manifest = gitManifest{Refs: map[string]string{}}
+	file, err := r.findFile(gitRefsFile)
+	if err != nil || file == nil {
+		return err
+	}
+	resp, err := r.service.Files.Get(file.Id).Download()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &r.manifest); err != nil {
+		return fmt.Errorf("corrupt %s: %v", gitRefsFile, err)
+	}
+	if r.manifest.Refs == nil {
+		r.manifest.Refs = map[string]string{}
+	}
+	r.manifestID, r.manifestMD5 = file.Id, file.Md5Checksum
+	return nil
+}
+
+// saveManifest writes refs.json to Drive in a single request, so readers
+// see either the old or the new refs. It refuses to overwrite refs.json
+// if it changed since it was loaded.
+func (r *gitRemote) saveManifest() error {
+	data, err := json.MarshalIndent(r.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	current, err := r.findFile(gitRefsFile)
+	if err != nil {
+		return err
+	}
+	if (current == nil && r.manifestID != "") || (current != nil && (current.Id != r.manifestID || current.Md5Checksum != r.manifestMD5)) {
+		return fmt.Errorf("%s changed during the push, fetch and push again", gitRefsFile)
+	}
+	if r.manifestID == "" {
+		file := &drive.File{Name: gitRefsFile, Parents: []string{r.folderID}, MimeType: "application/json"}
+		created, err := r.service.Files.Create(file).Media(bytes.NewReader(data)).Fields("id, md5Checksum").Do()
+		audit.record("create", gitRefsFile, driveIDOf(created), "", err)
+		if err != nil {
+			return err
+		}
+		r.manifestID, r.manifestMD5 = created.Id, created.Md5Checksum
+		return nil
+	}
+	updated, err := r.service.Files.Update(r.manifestID, nil).Media(bytes.NewReader(data)).Fields("id, md5Checksum").Do()
+	audit.record("update", gitRefsFile, r.manifestID, "", err)
+	if err != nil {
+		return err
+	}
+	r.manifestMD5 = updated.Md5Checksum
+	return nil
+}
+
+// driveIDOf returns the ID of a file that may not have been created.
+func driveIDOf(file *drive.File) string {
+	if file == nil {
+		return ""
+	}
+	return file.Id
+}
+
+// list answers the list command with the refs on Drive.
+func (r *gitRemote) list(out io.Writer) error {
+	if err := r.loadManifest(); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(r.manifest.Refs))
+	for name := range r.manifest.Refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "%s %s\n", r.manifest.Refs[name], name)
+	}
+	if _, ok := r.manifest.Refs[r.manifest.Head]; ok {
+		fmt.Fprintf(out, "@%s HEAD\n", r.manifest.Head)
+	}
+	fmt.Fprint(out, "\n")
+	return nil
+}
+
+// appliedBundles returns the IDs of the bundles already unbundled into the
+// local repository.
+func (r *gitRemote) appliedBundles() map[string]bool {
+	applied := map[string]bool{}
+	data, err := os.ReadFile(filepath.Join(r.cacheDir, "applied"))
+	if err != nil {
+		return applied
+	}
+	for _, id := range strings.Fields(string(data)) {
+		applied[id] = true
+	}
+	return applied
+}
+
+// markApplied remembers that a bundle was unbundled.
+func (r *gitRemote) markApplied(id string) error {
+	if err := os.MkdirAll(r.cacheDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(r.cacheDir, "applied"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, id); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fetch unbundles every bundle not applied yet, oldest first, which brings
+// in all objects reachable from the refs listed last.
+func (r *gitRemote) fetch() error {
+	applied := r.appliedBundles()
+	for _, b := range r.manifest.Bundles {
+		if applied[b.ID] {
+			continue
+		}
+		fmt.Printf("Fetching %s...\n", b.Name)
+		tmp := filepath.Join(r.cacheDir, b.Name)
+		if err := downloadFromDrive(r.service, b.ID, tmp); err != nil {
+			return fmt.Errorf("%s: %v", b.Name, err)
+		}
+		_, err := r.git("bundle", "unbundle", tmp)
+		os.Remove(tmp)
+		if err != nil {
+			return fmt.Errorf("%s: %v", b.Name, err)
+		}
+		if err := r.markApplied(b.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lock takes the push lock of the repository so concurrent pushes cannot
+// overwrite each other's refs. Every pusher creates a lock file and the
+// oldest one holds the lock; the others wait for it to be removed. The
+// holder refreshes its lock file while it pushes; lock files not refreshed
+// within GDRIVESYNC_GIT_LOCK_TTL are left behind by crashed pushes; they
+// are ignored and deleted by the next holder.
+func (r *gitRemote) lock() (unlock func(), err error) {
+	account, err := lockAccount()
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	file := &drive.File{
+		Name:    gitLockFile,
+		Parents: []string{r.folderID},
+		AppProperties: map[string]string{
+			lockHolderProperty: account,
+			lockHostProperty:   host,
+			lockTimeProperty:   time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	mine, err := r.service.Files.Create(file).Fields("id").Do()
+	audit.record("lock", gitLockFile, driveIDOf(mine), "", err)
+	if err != nil {
+		return nil, err
+	}
+	unlock = func() {
+		err := r.service.Files.Delete(mine.Id).Do()
+		audit.record("unlock", gitLockFile, mine.Id, "", err)
+		if err != nil {
+			log.Printf("Unable to remove %s: %v\n", gitLockFile, err)
+		}
+	}
+
+	ttl := envDuration("GDRIVESYNC_GIT_LOCK_TTL", 10*time.Minute)
+	deadline := time.Now().Add(envDuration("GDRIVESYNC_GIT_LOCK_WAIT", time.Minute))
+	for {
+		holder, err := r.lockHolder(ttl)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		if holder == nil || holder.Id == mine.Id {
+			r.removeExpiredLocks(ttl)
+			r.lockID, r.lockTTL = mine.Id, ttl
+			stop := r.refreshLock(mine.Id, ttl)
+			return func() {
+				stop()
+				r.lockID = ""
+				unlock()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			unlock()
+			return nil, fmt.Errorf("locked by %s on %s since %s", holder.AppProperties[lockHolderProperty],
+				holder.AppProperties[lockHostProperty], holder.CreatedTime)
+		}
+		fmt.Printf("Waiting for the push of %s to finish...\n", holder.AppProperties[lockHolderProperty])
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// refreshLock keeps a held push lock alive by updating its lock time every
+// third of ttl until the returned function is called.
+func (r *gitRemote) refreshLock(id string, ttl time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(max(ttl/3, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				patch := &drive.File{AppProperties: map[string]string{lockTimeProperty: time.Now().UTC().Format(time.RFC3339)}}
+				if _, err := r.service.Files.Update(id, patch).Fields("id").Do(); err != nil {
+					log.Printf("Unable to refresh %s: %v\n", gitLockFile, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// removeExpiredLocks deletes the lock files of crashed pushes. Only the
+// lock holder calls it, so live lock files are never removed.
+func (r *gitRemote) removeExpiredLocks(ttl time.Duration) {
+	files, err := r.lockFiles()
+	if err != nil {
+		log.Printf("Unable to list %s files: %v\n", gitLockFile, err)
+		return
+	}
+	_, expired := pickLockHolder(files, ttl, time.Now())
+	for _, f := range expired {
+		err := r.service.Files.Delete(f.Id).Do()
+		audit.record("unlock", gitLockFile, f.Id, "", err)
+		if err != nil {
+			log.Printf("Unable to remove expired %s: %v\n", gitLockFile, err)
+		}
+	}
+}
+
+// checkLockHeld returns an error unless this process still holds the push
+// lock, which it loses if refreshing failed for longer than the TTL.
+func (r *gitRemote) checkLockHeld() error {
+	holder, err := r.lockHolder(r.lockTTL)
+	if err != nil {
+		return err
+	}
+	if r.lockID == "" || holder == nil || holder.Id != r.lockID {
+		return fmt.Errorf("lost the push lock")
+	}
+	return nil
+}
+
+// lockFiles lists the push lock files in the repository folder.
+func (r *gitRemote) lockFiles() ([]*drive.File, error) {
+	query := fmt.Sprintf("name=%s and '%s' in parents and trashed=false", driveQueryString(gitLockFile), r.folderID)
+	list, err := r.service.Files.List().Q(query).Fields("files(id, createdTime, appProperties)").Do()
+	if err != nil {
+		return nil, err
+	}
+	return list.Files, nil
+}
+
+// lockHolder returns the lock file that holds the push lock, or nil if
+// there is none.
+func (r *gitRemote) lockHolder(ttl time.Duration) (*drive.File, error) {
+	files, err := r.lockFiles()
+	if err != nil {
+		return nil, err
+	}
+	holder, _ := pickLockHolder(files, ttl, time.Now())
+	return holder, nil
+}
+
+// pickLockHolder returns the oldest live lock file, one created or
+// refreshed within ttl before now, and the lock files that expired. Ties
+// are broken by ID so every pusher agrees on the holder.
+func pickLockHolder(files []*drive.File, ttl time.Duration, now time.Time) (holder *drive.File, expired []*drive.File) {
+	var holderTime time.Time
+	for _, f := range files {
+		created, err := time.Parse(time.RFC3339, f.CreatedTime)
+		if err != nil {
+			continue
+		}
+		refreshed := created
+		if t, err := time.Parse(time.RFC3339, f.AppProperties[lockTimeProperty]); err == nil && t.After(refreshed) {
+			refreshed = t
+		}
+		if now.Sub(refreshed) > ttl {
+			expired = append(expired, f)
+			continue
+		}
+		if holder == nil || created.Before(holderTime) || (created.Equal(holderTime) && f.Id < holder.Id) {
+			holder, holderTime = f, created
+		}
+	}
+	return holder, expired
+}
+
+// push answers a batch of push commands. The refs are checked and updated
+// while holding the push lock; a ref that moved on Drive since it was
+// fetched is only overwritten by a forced push.
+func (r *gitRemote) push(specs []string, out io.Writer) {
+	fail := func(err error) {
+		for _, spec := range specs {
+			_, dst, _ := strings.Cut(strings.TrimPrefix(spec, "+"), ":")
+			fmt.Fprintf(out, "error %s %s\n", dst, oneLine(err.Error()))
+		}
+	}
+	unlock, err := r.lock()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer unlock()
+	if err := r.loadManifest(); err != nil {
+		fail(err)
+		return
+	}
+
+	results := map[string]string{}
+	updates := map[string]string{}
+	var tips []string
+	for i, spec := range specs {
+		force := strings.HasPrefix(spec, "+")
+		src, dst, _ := strings.Cut(strings.TrimPrefix(spec, "+"), ":")
+		if src == "" {
+			updates[dst] = ""
+			continue
+		}
+		sha, err := r.git("rev-parse", "--verify", src)
+		if err != nil {
+			results[dst] = err.Error()
+			continue
+		}
+		if old, ok := r.manifest.Refs[dst]; ok && !force {
+			if reason := refUpdateRejection(old, sha, r.hasObject, r.isAncestor); reason != "" {
+				results[dst] = reason
+				continue
+			}
+		}
+		updates[dst] = sha
+		// git bundle only takes refs, so point a temporary one at the tip
+		tmpRef := fmt.Sprintf("refs/gdrive/push/%d", i)
+		if _, err := r.git("update-ref", tmpRef, sha); err != nil {
+			results[dst] = err.Error()
+			delete(updates, dst)
+			continue
+		}
+		defer r.git("update-ref", "-d", tmpRef)
+		tips = append(tips, tmpRef)
+	}
+
+	if len(tips) > 0 {
+		if err := r.pushBundle(tips); err != nil {
+			fail(err)
+			return
+		}
+	}
+	if len(updates) > 0 {
+		for dst, sha := range updates {
+			if sha == "" {
+				delete(r.manifest.Refs, dst)
+			} else {
+				r.manifest.Refs[dst] = sha
+			}
+		}
+		if _, ok := r.manifest.Refs[r.manifest.Head]; !ok {
+			r.manifest.Head = defaultGitHead(r.manifest.Refs)
+		}
+		// The lock may have been lost while the bundle was uploading
+		if err := r.checkLockHeld(); err != nil {
+			fail(err)
+			return
+		}
+		if err := r.saveManifest(); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	for _, spec := range specs {
+		_, dst, _ := strings.Cut(strings.TrimPrefix(spec, "+"), ":")
+		if msg, ok := results[dst]; ok {
+			fmt.Fprintf(out, "error %s %s\n", dst, oneLine(msg))
+		} else {
+			fmt.Fprintf(out, "ok %s\n", dst)
+		}
+	}
+}
+
+// isAncestor reports whether commit old is an ancestor of commit sha in
+// the local repository.
+func (r *gitRemote) isAncestor(old, sha string) bool {
+	_, err := r.git("merge-base", "--is-ancestor", old, sha)
+	return err == nil
+}
+
+// refUpdateRejection returns why a ref on Drive at old may not move to sha
+// without a forced push, or "" if it may. Drive's commit must be known
+// locally and reachable from sha.
+func refUpdateRejection(old, sha string, hasObject func(string) bool, isAncestor func(old, sha string) bool) string {
+	switch {
+	case old == sha:
+		return ""
+	case !hasObject(old):
+		return "fetch first"
+	case !isAncestor(old, sha):
+		return "non-fast-forward"
+	}
+	return ""
+}
+
+// oneLine collapses a message onto a single line, as the remote helper
+// protocol expects one answer per line.
+func oneLine(msg string) string {
+	return strings.Join(strings.Fields(msg), " ")
+}
+
+// pushBundle uploads a bundle with the objects reachable from tips that
+// the refs on Drive do not already reach. Nothing is uploaded if Drive
+// has every object.
+func (r *gitRemote) pushBundle(tips []string) error {
+	args := append([]string{"bundle", "create", ""}, tips...)
+	for _, sha := range r.manifest.Refs {
+		if r.hasObject(sha) {
+			args = append(args, "^"+sha)
+		}
+	}
+	if err := os.MkdirAll(r.cacheDir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s.bundle", time.Now().UTC().Format("20060102T150405.000000000Z"))
+	tmp := filepath.Join(r.cacheDir, name)
+	args[2] = tmp
+	defer os.Remove(tmp)
+	if _, err := r.git(args...); err != nil {
+		if strings.Contains(err.Error(), "empty bundle") {
+			return nil
+		}
+		return err
+	}
+
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Printf("Uploading %s...\n", name)
+	file := &drive.File{Name: name, Parents: []string{r.folderID}}
+	created, err := r.service.Files.Create(file).Media(f).Fields("id").Do()
+	audit.record("create", name, driveIDOf(created), "", err)
+	if err != nil {
+		return err
+	}
+	r.manifest.Bundles = append(r.manifest.Bundles, gitBundle{ID: created.Id, Name: name})
+	// The pusher already has these objects
+	return r.markApplied(created.Id)
+}
+
+// defaultGitHead picks the branch HEAD points to when it has none yet.
+func defaultGitHead(refs map[string]string) string {
+	for _, name := range []string{"refs/heads/main", "refs/heads/master"} {
+		if _, ok := refs[name]; ok {
+			return name
+		}
+	}
+	var branches []string
+	for name := range refs {
+		if strings.HasPrefix(name, "refs/heads/") {
+			branches = append(branches, name)
+		}
+	}
+	if len(branches) == 0 {
+		return ""
+	}
+	sort.Strings(branches)
+	return branches[0]
+}
+
+// isGitRemoteHelper reports whether the binary was started by git as its
+// remote helper, i.e. installed or linked as git-remote-gdrive.
+func isGitRemoteHelper() bool {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	return name == gitRemoteHelper
+}
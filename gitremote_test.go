@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestDefaultGitHead(t *testing.T) {
+	tests := []struct {
+		name string
+		refs []string
+		want string
+	}{
+		{"empty", nil, ""},
+		{"main", []string{"refs/heads/feature", "refs/heads/main", "refs/heads/master"}, "refs/heads/main"},
+		{"master", []string{"refs/heads/feature", "refs/heads/master"}, "refs/heads/master"},
+		{"first branch", []string{"refs/heads/zeta", "refs/heads/alpha", "refs/tags/v1"}, "refs/heads/alpha"},
+		{"tags only", []string{"refs/tags/v1"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refs := map[string]string{}
+			for _, name := range tt.refs {
+				refs[name] = "0123456789abcdef0123456789abcdef01234567"
+			}
+			if got := defaultGitHead(refs); got != tt.want {
+				t.Errorf("defaultGitHead() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefUpdateRejection(t *testing.T) {
+	// c1 <- c2 <- c3 is the local history, c9 is only on Drive and c5 is
+	// a local commit on another branch
+	parents := map[string]string{"c2": "c1", "c3": "c2", "c5": "c1"}
+	hasObject := func(sha string) bool { return sha != "c9" }
+	isAncestor := func(old, sha string) bool {
+		for ; sha != ""; sha = parents[sha] {
+			if sha == old {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		name     string
+		old, sha string
+		want     string
+	}{
+		{"unchanged", "c3", "c3", ""},
+		{"fast-forward", "c1", "c3", ""},
+		{"unknown remote commit", "c9", "c3", "fetch first"},
+		{"diverged", "c3", "c5", "non-fast-forward"},
+		{"rewind", "c3", "c2", "non-fast-forward"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refUpdateRejection(tt.old, tt.sha, hasObject, isAncestor); got != tt.want {
+				t.Errorf("refUpdateRejection(%s, %s) = %q, want %q", tt.old, tt.sha, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickLockHolder(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ttl := 10 * time.Minute
+	lockFile := func(id string, created, refreshed time.Duration) *drive.File {
+		f := &drive.File{Id: id, CreatedTime: now.Add(-created).Format(time.RFC3339)}
+		if refreshed > 0 {
+			f.AppProperties = map[string]string{lockTimeProperty: now.Add(-refreshed).Format(time.RFC3339)}
+		}
+		return f
+	}
+
+	tests := []struct {
+		name        string
+		files       []*drive.File
+		wantHolder  string
+		wantExpired []string
+	}{
+		{"no locks", nil, "", nil},
+		{"oldest wins", []*drive.File{lockFile("b", time.Minute, 0), lockFile("a", 2*time.Minute, 0)}, "a", nil},
+		{"tie broken by ID", []*drive.File{lockFile("b", time.Minute, 0), lockFile("a", time.Minute, 0)}, "a", nil},
+		{"expired lock skipped", []*drive.File{lockFile("old", time.Hour, 0), lockFile("new", time.Minute, 0)}, "new", []string{"old"}},
+		{"refreshed lock kept", []*drive.File{lockFile("old", time.Hour, time.Minute), lockFile("new", time.Minute, 0)}, "old", nil},
+		{"all expired", []*drive.File{lockFile("a", time.Hour, 30*time.Minute)}, "", []string{"a"}},
+		{"unparsable time", []*drive.File{{Id: "bad", CreatedTime: "yesterday"}}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holder, expired := pickLockHolder(tt.files, ttl, now)
+			if got := driveIDOf(holder); got != tt.wantHolder {
+				t.Errorf("holder = %q, want %q", got, tt.wantHolder)
+			}
+			var ids []string
+			for _, f := range expired {
+				ids = append(ids, f.Id)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.wantExpired) {
+				t.Errorf("expired = %v, want %v", ids, tt.wantExpired)
+			}
+		})
+	}
+}
+
+func TestOneLine(t *testing.T) {
+	msg := "git update-ref: exit status 128: fatal: cannot lock ref\n  'refs/heads/main':\r\n\tunable to create lock\n"
+	want := "git update-ref: exit status 128: fatal: cannot lock ref 'refs/heads/main': unable to create lock"
+	if got := oneLine(msg); got != want {
+		t.Errorf("oneLine() = %q, want %q", got, want)
+	}
+}
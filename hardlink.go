@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// remoteLinksFile is a manifest at the root of the remote mapping every
+// further name of a hard linked file to the name whose content was
+// uploaded, so a pull without the local sync state still restores links.
+const remoteLinksFile = ".gdrivesync-links.json"
+
+// isSpecialFile reports whether a file is a FIFO, socket, device or other
+// irregular file whose content cannot be synced. Opening a FIFO would
+// block until a writer shows up.
+func isSpecialFile(mode os.FileMode) bool {
+	return mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0
+}
+
+// withoutHardLinks drops files that are further names of a hard linked
+// file, so its content is uploaded once, and records each link in the
+// sync state for pushHardLinks.
+func withoutHardLinks(files []File, state *syncState) []File {
+	kept := files[:0]
+	for _, file := range files {
+		if file.LinkOf == "" {
+			kept = append(kept, file)
+			continue
+		}
+		state.set(filepath.ToSlash(file.Name), stateEntry{LinkOf: file.LinkOf})
+	}
+	return kept
+}
+
+// hardLinks returns the hard links recorded in the sync state, by name.
+func hardLinks(state *syncState) map[string]string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	links := map[string]string{}
+	for rel, entry := range state.Files {
+		if entry.LinkOf != "" {
+			links[rel] = entry.LinkOf
+		}
+	}
+	return links
+}
+
+// pushHardLinks uploads the manifest of the recorded hard links. Remotes
+// that never had hard links get no manifest.
+func pushHardLinks(b backend, state *syncState) error {
+	links := hardLinks(state)
+	state.mu.Lock()
+	had := state.HasLinks
+	state.mu.Unlock()
+	if len(links) == 0 && !had {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp("", "gdrivesync-links-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := b.upload(tmp.Name(), remoteLinksFile); err != nil {
+		return err
+	}
+	state.mu.Lock()
+	state.HasLinks = true
+	state.mu.Unlock()
+	return nil
+}
+
+// pullHardLinks reads the manifest of hard links, obj, into the sync state
+// so restoreHardLinks recreates them. Local names that are neither linked
+// nor a file on the remote anymore were deleted there and go to the local
+// trash.
+func pullHardLinks(b backend, root string, obj remoteObject, remote map[string]remoteObject, state *syncState) error {
+	tmp, err := os.CreateTemp("", "gdrivesync-links-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := b.download(obj, tmp.Name()); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+	var links map[string]string
+	if err := json.Unmarshal(data, &links); err != nil {
+		return fmt.Errorf("corrupt %s: %v", remoteLinksFile, err)
+	}
+
+	for rel, target := range hardLinks(state) {
+		if links[rel] == target {
+			continue
+		}
+		_, linked := links[rel]
+		if _, ok := remote[rel]; !ok && !linked {
+			fmt.Printf("Removing %s (deleted on %s)...\n", rel, b)
+			if err := moveToLocalTrash(root, state.trashStamp(), filepath.FromSlash(rel)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing %s: %v\n", rel, err)
+				continue
+			}
+		}
+		state.remove(rel)
+	}
+	for rel, target := range links {
+		state.set(rel, stateEntry{LinkOf: target})
+	}
+	state.mu.Lock()
+	state.HasLinks = true
+	state.mu.Unlock()
+	return nil
+}
+
+// restoreHardLinks recreates recorded hard links below root once their
+// target exists. Names that are missing, or that still hold the old content
+// because a pull replaced the target with a new file, are linked to the
+// target again. Only regular files are linked; symlinks are never followed.
+// Links whose target is gone are forgotten.
+func restoreHardLinks(root string, state *syncState) {
+	links := hardLinks(state)
+	names := make([]string, 0, len(links))
+	for rel := range links {
+		names = append(names, rel)
+	}
+	sort.Strings(names)
+
+	for _, rel := range names {
+		linkPath := filepath.Join(root, filepath.FromSlash(rel))
+		targetPath := filepath.Join(root, filepath.FromSlash(links[rel]))
+		target, err := os.Lstat(targetPath)
+		if err != nil {
+			state.remove(rel)
+			continue
+		}
+		if !target.Mode().IsRegular() {
+			log.Printf("Not linking %s: %s is not a regular file\n", rel, links[rel])
+			continue
+		}
+		if link, err := os.Lstat(linkPath); err == nil {
+			if os.SameFile(link, target) {
+				continue
+			}
+			if !link.Mode().IsRegular() {
+				log.Printf("Not linking %s: not a regular file\n", rel)
+				continue
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+			log.Printf("Error linking %s: %v\n", rel, err)
+			continue
+		}
+		fmt.Printf("Linking %s to %s...\n", rel, links[rel])
+		if err := relink(targetPath, linkPath); err != nil {
+			log.Printf("Error linking %s: %v\n", rel, err)
+		}
+	}
+}
+
+// relink makes linkPath a hard link to targetPath, atomically replacing a
+// file already at linkPath.
+func relink(targetPath, linkPath string) error {
+	tmp := filepath.Join(filepath.Dir(linkPath), fmt.Sprintf(".gdrivesync-link-%d", os.Getpid()))
+	os.Remove(tmp)
+	if err := os.Link(targetPath, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, linkPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreHardLinks(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup prepares root, which has a.txt, and returns whether b.txt
+		// should end up linked to a.txt.
+		setup func(t *testing.T, root string) bool
+	}{
+		{"missing link", func(t *testing.T, root string) bool {
+			return true
+		}},
+		{"already linked", func(t *testing.T, root string) bool {
+			mustLink(t, filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt"))
+			return true
+		}},
+		{"target replaced by pull", func(t *testing.T, root string) bool {
+			mustLink(t, filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt"))
+			// Pulls write a temporary file and rename it over the target
+			tmp := filepath.Join(root, ".gdrivesync-tmp")
+			mustWrite(t, tmp, "new content")
+			if err := os.Rename(tmp, filepath.Join(root, "a.txt")); err != nil {
+				t.Fatal(err)
+			}
+			return true
+		}},
+		{"symlinked target", func(t *testing.T, root string) bool {
+			mustWrite(t, filepath.Join(root, "real.txt"), "content")
+			os.Remove(filepath.Join(root, "a.txt"))
+			if err := os.Symlink("real.txt", filepath.Join(root, "a.txt")); err != nil {
+				t.Skip("symlinks not supported:", err)
+			}
+			return false
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			mustWrite(t, filepath.Join(root, "a.txt"), "content")
+			want := tt.setup(t, root)
+			state := &syncState{Files: map[string]stateEntry{"b.txt": {LinkOf: "a.txt"}}}
+
+			restoreHardLinks(root, state)
+
+			target, err := os.Lstat(filepath.Join(root, "a.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			link, err := os.Lstat(filepath.Join(root, "b.txt"))
+			linked := err == nil && os.SameFile(target, link)
+			if linked != want {
+				t.Errorf("b.txt linked to a.txt = %v, want %v", linked, want)
+			}
+		})
+	}
+}
+
+func TestRestoreHardLinksForgetsMissingTarget(t *testing.T) {
+	root := t.TempDir()
+	state := &syncState{Files: map[string]stateEntry{"b.txt": {LinkOf: "a.txt"}}}
+	restoreHardLinks(root, state)
+	if _, ok := state.get("b.txt"); ok {
+		t.Error("link to a missing target is still recorded")
+	}
+}
+
+func mustWrite(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustLink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Link(target, link); err != nil {
+		t.Skip("hard links not supported:", err)
+	}
+}
+
+func TestHardLinksRoundTrip(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+	t.Setenv("GDRIVESYNC_RULES", filepath.Join(t.TempDir(), "rules.json"))
+	hashes = loadHashCache(filepath.Join(t.TempDir(), "hashcache.json"))
+
+	src := t.TempDir()
+	mustWrite(t, filepath.Join(src, "a.txt"), "shared")
+	mustLink(t, filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt"))
+	remote := t.TempDir()
+	b := &localBackend{root: remote}
+	pair := syncPair{Name: "links", Local: src, Remote: "file://" + remote}
+	if err := syncFolder(b, pair, loadSyncState(pair.stateFile())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("further name of the link uploaded: %v", err)
+	}
+
+	// A pull without the sync state learns the links from the remote
+	dest := t.TempDir()
+	if err := pullFolder(b, dest, &syncState{Files: map[string]stateEntry{}}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := os.Stat(filepath.Join(dest, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked, err := os.Stat(filepath.Join(dest, "b.txt"))
+	if err != nil || !os.SameFile(a, linked) {
+		t.Errorf("b.txt not linked to a.txt after pull: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, remoteLinksFile)); !os.IsNotExist(err) {
+		t.Errorf("%s pulled as a file: %v", remoteLinksFile, err)
+	}
+}
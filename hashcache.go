@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const hashCacheFile = "hashcache.json"
+
+// hashCacheEntry records the MD5 of a local file together with the inode,
+// size and modification time it was computed for.
+type hashCacheEntry struct {
+	Inode   uint64 `json:"inode"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	MD5     string `json:"md5"`
+}
+
+// hashCache is a persistent map from local path to MD5 so unchanged files
+// are never read twice.
+type hashCache struct {
+	mu      sync.Mutex
+	file    string
+	entries map[string]hashCacheEntry
+	dirty   bool
+	seen    map[string]bool // paths looked up or listed during this run
+	partial bool            // some folder was not listed, so prune is skipped
+}
+
+// hashes is the cache shared by all sync workers.
+var hashes = &hashCache{file: hashCacheFile, entries: map[string]hashCacheEntry{}, seen: map[string]bool{}}
+
+// loadHashCache reads the cache from a local file. A missing or unreadable
+// cache yields an empty one.
+func loadHashCache(cacheFile string) *hashCache {
+	c := &hashCache{file: cacheFile, entries: map[string]hashCacheEntry{}, seen: map[string]bool{}}
+	data, err := os.ReadFile(cacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Unable to read hash cache: %v\n", err)
+		}
+		return c
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		log.Printf("Ignoring corrupt hash cache: %v\n", err)
+		c.entries = map[string]hashCacheEntry{}
+	}
+	return c
+}
+
+// md5 returns the hex MD5 of the file at path, reading the file only when
+// its inode, size or modification time differ from the cached entry.
+func (c *hashCache) md5(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.seen[key] = true
+	c.mu.Unlock()
+	if ok && entry.Inode == fileInode(info) && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() {
+		return entry.MD5, nil
+	}
+
+	sum, err := fileMD5(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = hashCacheEntry{
+		Inode:   fileInode(info),
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		MD5:     sum,
+	}
+	c.dirty = true
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// markSeen records that the file at path still exists, so prune keeps its
+// entry even if the run never needed its hash.
+func (c *hashCache) markSeen(path string) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[key] = true
+}
+
+// keepUnseen stops prune from dropping anything this run, for runs that do
+// not list every local file, such as a resumed sync.
+func (c *hashCache) keepUnseen() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.partial = true
+}
+
+// prune drops the entries of files that were not seen during the run, such
+// as files that were deleted or renamed. It must only be called after a run
+// that listed every local folder.
+func (c *hashCache) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.partial {
+		return
+	}
+	for key := range c.entries {
+		if !c.seen[key] {
+			delete(c.entries, key)
+			c.dirty = true
+		}
+	}
+	c.seen = map[string]bool{}
+}
+
+// save writes the cache back to disk if it changed.
+func (c *hashCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	tmp := c.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.file); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// rebuildHashCache discards the cache and rehashes every file in folders.
+func rebuildHashCache(cacheFile string, folders []string) error {
+	c := &hashCache{file: cacheFile, entries: map[string]hashCacheEntry{}, seen: map[string]bool{}, dirty: true}
+	count := 0
+	for _, folder := range folders {
+		files, err := listLocalFiles(folder)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if _, err := c.md5(file.Path); err != nil {
+				return fmt.Errorf("hashing %s: %v", file.Path, err)
+			}
+		}
+		count += len(files)
+	}
+	fmt.Printf("Hashed %d files.\n", count)
+	return c.save()
+}
+
+// fileMD5 computes the hex MD5 of a local file.
+func fileMD5(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// beginRun prepares the state for a sync run. An incremental run only
+// considers files changed since the watermark, unless no run has succeeded
+// yet or the last full run is older than GDRIVESYNC_FULL_SYNC_INTERVAL
+// (default 7 days).
+func (st *syncState) beginRun(incremental bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.runStart = time.Now()
+	st.since = time.Time{}
+	st.full = true
+	if !incremental || st.Watermark.IsZero() {
+		return
+	}
+	if time.Since(st.LastFull) >= envDuration("GDRIVESYNC_FULL_SYNC_INTERVAL", 7*24*time.Hour) {
+		fmt.Println("Running a full reconciliation.")
+		return
+	}
+	st.since = st.Watermark
+	st.full = false
+	fmt.Printf("Incremental run, considering files changed since %s.\n", st.since.Format(time.RFC3339))
+}
+
+// resumeRun records that the run continues a plan made at created, so the
+// watermark does not move past changes the plan could not include.
+func (st *syncState) resumeRun(created time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if created.Before(st.runStart) {
+		st.runStart = created
+	}
+}
+
+// finishRun advances the watermark to the start of a run that completed
+// without errors.
+func (st *syncState) finishRun() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.Watermark = st.runStart
+	if st.full {
+		st.LastFull = st.runStart
+	}
+}
+
+// changedSince drops the files whose modification and change times, as
+// listed, are both before since. A zero since keeps every file.
+func changedSince(files []File, since time.Time) []File {
+	if since.IsZero() {
+		return files
+	}
+	kept := files[:0]
+	for _, file := range files {
+		if file.ModTime.IsZero() || file.ModTime.After(since) || file.ChangeTime.After(since) {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileInode returns 0 on platforms without inode numbers; size and
+// modification time alone then decide cache validity.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
+
+// fileDevice returns 0, so every file appears to be on one file system.
+func fileDevice(info os.FileInfo) uint64 {
+	return 0
+}
+
+// fileLinks returns 1, so no file is treated as a hard link.
+func fileLinks(info os.FileInfo) uint64 {
+	return 1
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	journalDir = "journal"
+	// journalUndoneSuffix marks journals whose run has been reverted.
+	journalUndoneSuffix = ".undone"
+)
+
+// Journal actions.
+const (
+	actionCreate     = "create"
+	actionUpdate     = "update"
+	actionTrash      = "trash"
+	actionMove       = "move"
+	actionProperties = "properties"
+	actionMetadata   = "metadata"
+)
+
+// journalEntry records one mutating call made during a run, with what is
+// needed to revert it.
+type journalEntry struct {
+	Time           time.Time `json:"time"`
+	Action         string    `json:"action"`
+	Path           string    `json:"path,omitempty"`
+	DriveID        string    `json:"driveId"`
+	PrevRevisionID string    `json:"prevRevisionId,omitempty"`
+	OldParents     []string  `json:"oldParents,omitempty"`
+	NewParents     []string  `json:"newParents,omitempty"`
+	OldName        string    `json:"oldName,omitempty"`
+	// PrevAppProperties holds the previous values of the app properties a
+	// call changed; an empty value means the property was not set.
+	PrevAppProperties map[string]string `json:"prevAppProperties,omitempty"`
+	PrevReadOnly      *bool             `json:"prevReadOnly,omitempty"`
+	PrevMetadata      *fileMetadata     `json:"prevMetadata,omitempty"`
+	// Remote is the URL of a non-Drive backend the entry applies to, in
+	// which case Path is relative to it.
+	Remote string `json:"remote,omitempty"`
+}
+
+// runJournal appends the mutations of a single run to a JSON lines file.
+type runJournal struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries int
+}
+
+// journal is the journal of the current run. Recording on a nil journal is
+// a no-op.
+var journal *runJournal
+
+// openJournal starts a new journal file for this run of command. The
+// command is part of the file name, so undo can tell syncs apart from
+// watch or serve sessions.
+func openJournal(dir, command string) (*runJournal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, time.Now().UTC().Format("20060102T150405.000000000")+"-"+command+".jsonl")
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &runJournal{file: file}, nil
+}
+
+// record appends an entry and flushes it to disk immediately so a crashed
+// run can still be undone.
+func (j *runJournal) record(entry journalEntry) {
+	if j == nil {
+		return
+	}
+	entry.Time = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Unable to journal %s of %s: %v\n", entry.Action, entry.DriveID, err)
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		log.Printf("Unable to journal %s of %s: %v\n", entry.Action, entry.DriveID, err)
+		return
+	}
+	j.file.Sync()
+	j.entries++
+}
+
+// close finishes the journal, removing it if the run changed nothing.
+func (j *runJournal) close() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.file.Close()
+	if j.entries == 0 {
+		os.Remove(j.file.Name())
+	}
+}
+
+// readJournal loads the entries of a journal file.
+func readJournal(name string) ([]journalEntry, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A crash may leave a partial last line behind
+			log.Printf("Skipping unreadable journal line in %s: %v\n", name, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// journalCommand returns the command that wrote a journal file, or "" for
+// journals written before commands were recorded.
+func journalCommand(name string) string {
+	_, command, _ := strings.Cut(strings.TrimSuffix(filepath.Base(name), ".jsonl"), "-")
+	return command
+}
+
+// latestJournal returns the most recent journal that has not been undone
+// and was written by one of commands, or by any command if commands is
+// empty.
+func latestJournal(dir string, commands []string) (string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(names)
+	wanted := map[string]bool{}
+	for _, command := range commands {
+		wanted[command] = true
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		if len(wanted) > 0 && !wanted[journalCommand(names[i])] {
+			continue
+		}
+		// Runs that died before changing anything leave empty journals
+		if info, err := os.Stat(names[i]); err == nil && info.Size() > 0 {
+			return names[i], nil
+		}
+	}
+	if len(commands) == 0 {
+		return "", fmt.Errorf("no run to undo")
+	}
+	return "", fmt.Errorf("no %s run to undo", strings.Join(commands, " or "))
+}
+
+// undoJournal reverts the entries of a journal in reverse order: created
+// items are deleted, updated files get their previous revision back,
+// trashed items are restored, moved items are moved back and changed
+// properties and metadata get their previous values. It returns the
+// entries that could not be undone.
+func undoJournal(service func() *drive.Service, entries []journalEntry, dryRun bool) []journalEntry {
+	var failed []journalEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		label := entry.Path
+		if label == "" {
+			label = entry.DriveID
+		}
+		if dryRun {
+			fmt.Printf("Would undo %s of %s\n", entry.Action, label)
+			continue
+		}
+
+		fmt.Printf("Undoing %s of %s...\n", entry.Action, label)
+		err := undoEntry(service, entry)
+		audit.record("undo-"+entry.Action, entry.Path, entry.DriveID, "", err)
+		if err != nil {
+			log.Printf("Error undoing %s of %s: %v\n", entry.Action, label, err)
+			failed = append([]journalEntry{entry}, failed...)
+		}
+	}
+	return failed
+}
+
+// writeJournal replaces the contents of a journal file.
+func writeJournal(name string, entries []journalEntry) error {
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+// undoEntry reverts a single journaled action.
+func undoEntry(service func() *drive.Service, entry journalEntry) error {
+	if entry.Remote != "" {
+		return undoBackendEntry(service, entry)
+	}
+
+	switch entry.Action {
+	case actionCreate:
+		return service().Files.Delete(entry.DriveID).Do()
+
+	case actionUpdate:
+		if entry.PrevRevisionID == "" {
+			return fmt.Errorf("no previous revision recorded")
+		}
+		resp, err := service().Revisions.Get(entry.DriveID, entry.PrevRevisionID).Download()
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = service().Files.Update(entry.DriveID, appPropertiesPatch(entry.PrevAppProperties)).Media(resp.Body).Do()
+		return err
+
+	case actionTrash:
+		_, err := service().Files.Update(entry.DriveID, &drive.File{Trashed: false, ForceSendFields: []string{"Trashed"}}).Do()
+		return err
+
+	case actionMove:
+		patch := &drive.File{}
+		if entry.OldName != "" {
+			patch.Name = entry.OldName
+		}
+		call := service().Files.Update(entry.DriveID, patch)
+		if len(entry.OldParents) > 0 || len(entry.NewParents) > 0 {
+			call = call.AddParents(strings.Join(entry.OldParents, ",")).RemoveParents(strings.Join(entry.NewParents, ","))
+		}
+		_, err := call.Do()
+		return err
+
+	case actionProperties:
+		patch := appPropertiesPatch(entry.PrevAppProperties)
+		if patch == nil {
+			patch = &drive.File{}
+		}
+		if entry.PrevReadOnly != nil {
+			patch.ContentRestrictions = []*drive.ContentRestriction{{ReadOnly: *entry.PrevReadOnly, ForceSendFields: []string{"ReadOnly"}}}
+		}
+		_, err := service().Files.Update(entry.DriveID, patch).Fields("id").Do()
+		return err
+
+	case actionMetadata:
+		if entry.PrevMetadata == nil {
+			return fmt.Errorf("no previous metadata recorded")
+		}
+		current, err := service().Files.Get(entry.DriveID).Fields("id, description, starred, properties").Do()
+		if err != nil {
+			return err
+		}
+		patch := metadataPatch(metadataOf(current), *entry.PrevMetadata)
+		if patch == nil {
+			return nil
+		}
+		_, err = service().Files.Update(entry.DriveID, patch).Fields("id").Do()
+		return err
+	}
+	return fmt.Errorf("unknown action %q", entry.Action)
+}
+
+// undoBackendEntry reverts an action on a non-Drive backend. Only created
+// objects can be undone, since these backends keep no earlier versions.
+func undoBackendEntry(service func() *drive.Service, entry journalEntry) error {
+	b, err := openBackend(entry.Remote, service)
+	if err != nil {
+		return err
+	}
+	if entry.Action != actionCreate {
+		return fmt.Errorf("%s on %s cannot be undone", entry.Action, b)
+	}
+	return b.remove(entry.Path)
+}
+
+// prevAppProperties returns the values the app properties named in changes
+// had before they were changed.
+func prevAppProperties(have, changes map[string]string) map[string]string {
+	if len(changes) == 0 {
+		return nil
+	}
+	prev := make(map[string]string, len(changes))
+	for k := range changes {
+		prev[k] = have[k]
+	}
+	return prev
+}
+
+// runUndo reverts the most recent sync run.
+func runUndo(args []string) {
+	flags := flag.NewFlagSet("undo", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only show what would be undone")
+	yes := flags.Bool("yes", false, "do not ask for confirmation")
+	commands := flags.String("command", "sync,pull", "comma separated commands whose last run is undone, or all")
+	flags.Parse(args)
+
+	var kinds []string
+	if *commands != "all" {
+		kinds = strings.Split(*commands, ",")
+	}
+	name, err := latestJournal(journalDir, kinds)
+	if err != nil {
+		log.Fatalf("Nothing to undo: %v", err)
+	}
+	entries, err := readJournal(name)
+	if err != nil {
+		log.Fatalf("Unable to read journal: %v", err)
+	}
+	fmt.Printf("Run %s made %d changes.\n", strings.TrimSuffix(filepath.Base(name), ".jsonl"), len(entries))
+
+	if !*dryRun && !*yes && !confirm("Undo them?") {
+		fmt.Println("Aborted.")
+		return
+	}
+
+	failed := undoJournal(lazyDriveService(), entries, *dryRun)
+	if *dryRun {
+		return
+	}
+	if len(failed) > 0 {
+		// Keep only what is left so the next undo retries just those
+		if err := writeJournal(name, failed); err != nil {
+			log.Printf("Unable to update journal: %v\n", err)
+		}
+		log.Fatalf("%d of %d changes could not be undone", len(failed), len(entries))
+	}
+	if err := os.Rename(name, name+journalUndoneSuffix); err != nil {
+		log.Printf("Unable to mark journal as undone: %v\n", err)
+	}
+	fmt.Println("Undo complete.")
+}
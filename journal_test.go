@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLatestJournal(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"20240101T100000.000000000.jsonl":              "{}\n",
+		"20240102T100000.000000000-sync.jsonl":         "{}\n",
+		"20240103T100000.000000000-sync.jsonl.undone":  "{}\n",
+		"20240104T100000.000000000-watch.jsonl":        "{}\n",
+		"20240105T100000.000000000-sync.jsonl":         "",
+		"20240106T100000.000000000-serve.jsonl":        "{}\n",
+		"20240107T100000.000000000-lock.jsonl.undone":  "{}\n",
+		"20240108T100000.000000000-unlock.jsonl":       "",
+		"20240109T100000.000000000-trash.jsonl.undone": "{}\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		commands []string
+		want     string
+		wantErr  string
+	}{
+		{[]string{"sync", "pull"}, "20240102T100000.000000000-sync.jsonl", ""},
+		{[]string{"watch"}, "20240104T100000.000000000-watch.jsonl", ""},
+		{nil, "20240106T100000.000000000-serve.jsonl", ""},
+		{[]string{"pull"}, "", "no pull run to undo"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.commands, ","), func(t *testing.T) {
+			got, err := latestJournal(dir, tt.commands)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("latestJournal() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Base(got) != tt.want {
+				t.Errorf("latestJournal() = %s, want %s", filepath.Base(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// runLimits caps how much a single run may change, so a sync pointed at
+// the wrong folder aborts instead of uploading or deleting everything.
+// Zero disables a limit.
+type runLimits struct {
+	MaxDeletes        int
+	MaxUploadBytes    int64
+	MaxChangedPercent float64
+	Force             bool
+}
+
+// limits are the limits of the current run.
+var limits runLimits
+
+// loadRunLimits reads the limits from the environment:
+//
+//	GDRIVESYNC_MAX_DELETES          files a run may delete
+//	GDRIVESYNC_MAX_UPLOAD_BYTES     bytes a run may upload
+//	GDRIVESYNC_MAX_CHANGED_PERCENT  share of the tree a run may change
+//
+// With force the limits are reported but not enforced.
+func loadRunLimits(force bool) runLimits {
+	return runLimits{
+		MaxDeletes:        envInt("GDRIVESYNC_MAX_DELETES", 0),
+		MaxUploadBytes:    int64(envInt("GDRIVESYNC_MAX_UPLOAD_BYTES", 0)),
+		MaxChangedPercent: envFloat("GDRIVESYNC_MAX_CHANGED_PERCENT", 0),
+		Force:             force,
+	}
+}
+
+// enabled reports whether any limit is set.
+func (l runLimits) enabled() bool {
+	return l.MaxDeletes > 0 || l.MaxUploadBytes > 0 || l.MaxChangedPercent > 0
+}
+
+// runPlan summarizes the changes a run is about to make.
+type runPlan struct {
+	Files       int // files in the tree
+	Changed     int // files to upload or download
+	Deletes     int // files to delete
+	UploadBytes int64
+}
+
+// check returns an error if plan exceeds a limit, unless forced.
+func (l runLimits) check(plan runPlan) error {
+	var exceeded string
+	switch {
+	case l.MaxDeletes > 0 && plan.Deletes > l.MaxDeletes:
+		exceeded = fmt.Sprintf("would delete %d files, more than GDRIVESYNC_MAX_DELETES=%d", plan.Deletes, l.MaxDeletes)
+	case l.MaxUploadBytes > 0 && plan.UploadBytes > l.MaxUploadBytes:
+		exceeded = fmt.Sprintf("would upload %d bytes, more than GDRIVESYNC_MAX_UPLOAD_BYTES=%d", plan.UploadBytes, l.MaxUploadBytes)
+	case l.MaxChangedPercent > 0 && plan.Files > 0 && float64(plan.Changed+plan.Deletes)*100/float64(plan.Files) > l.MaxChangedPercent:
+		exceeded = fmt.Sprintf("would change %d of %d files, more than GDRIVESYNC_MAX_CHANGED_PERCENT=%g", plan.Changed+plan.Deletes, plan.Files, l.MaxChangedPercent)
+	default:
+		return nil
+	}
+	if l.Force {
+		fmt.Printf("Run %s; continuing because of --force.\n", exceeded)
+		return nil
+	}
+	return fmt.Errorf("run %s; rerun with --force to proceed", exceeded)
+}
+
+// planUpload counts the local files whose content differs from what was
+// last synced. total is the number of files in the local tree, of which an
+// incremental run only considers those that changed.
+func planUpload(files []File, total int, state *syncState) (runPlan, error) {
+	plan := runPlan{Files: total}
+	for _, file := range files {
+		sum, err := hashes.md5(file.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return plan, err
+		}
+		if entry, ok := state.get(filepath.ToSlash(file.Name)); ok && entry.MD5 == sum {
+			continue
+		}
+		plan.Changed++
+		plan.UploadBytes += file.Size
+	}
+	return plan, nil
+}
+
+// planPull counts the downloads and deletions a pull would make. remote
+// maps every remote path to its MD5, empty for items without content.
+func planPull(remote map[string]string, local map[string]File, state *syncState) (runPlan, error) {
+	plan := runPlan{Files: len(remote)}
+	for rel, sum := range remote {
+		if sum == "" {
+			continue
+		}
+		lf, ok := local[rel]
+		if !ok {
+			plan.Changed++
+			continue
+		}
+		localSum, err := hashes.md5(lf.Path)
+		if err != nil {
+			return plan, err
+		}
+		if localSum != sum {
+			plan.Changed++
+		}
+	}
+	for rel := range local {
+		if _, ok := remote[rel]; ok {
+			continue
+		}
+		if entry, ok := state.get(rel); ok && entry.LinkOf == "" {
+			plan.Deletes++
+		}
+	}
+	if len(local) > plan.Files {
+		plan.Files = len(local)
+	}
+	return plan, nil
+}
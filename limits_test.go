@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunLimitsCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  runLimits
+		plan    runPlan
+		wantErr string
+	}{
+		{"no limits", runLimits{}, runPlan{Files: 10, Changed: 10, Deletes: 10, UploadBytes: 1 << 30}, ""},
+		{"deletes within", runLimits{MaxDeletes: 5}, runPlan{Files: 10, Deletes: 5}, ""},
+		{"deletes exceeded", runLimits{MaxDeletes: 5}, runPlan{Files: 10, Deletes: 6}, "GDRIVESYNC_MAX_DELETES"},
+		{"bytes exceeded", runLimits{MaxUploadBytes: 100}, runPlan{Files: 1, Changed: 1, UploadBytes: 101}, "GDRIVESYNC_MAX_UPLOAD_BYTES"},
+		{"percent within", runLimits{MaxChangedPercent: 50}, runPlan{Files: 10, Changed: 3, Deletes: 2}, ""},
+		{"percent exceeded", runLimits{MaxChangedPercent: 50}, runPlan{Files: 10, Changed: 4, Deletes: 2}, "GDRIVESYNC_MAX_CHANGED_PERCENT"},
+		{"percent of empty tree", runLimits{MaxChangedPercent: 50}, runPlan{}, ""},
+		{"forced", runLimits{MaxDeletes: 1, Force: true}, runPlan{Files: 10, Deletes: 6}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.check(tt.plan)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("error = %v, want one naming %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// limitsTree creates files with the given contents below a new folder and
+// returns them as listed.
+func limitsTree(t *testing.T, contents map[string]string) (string, []File) {
+	t.Helper()
+	hashes = loadHashCache(filepath.Join(t.TempDir(), "hashcache.json"))
+	root := t.TempDir()
+	for rel, content := range contents {
+		if err := os.WriteFile(filepath.Join(root, rel), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := listLocalFiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, files
+}
+
+func TestPlanUpload(t *testing.T) {
+	const helloMD5 = "5d41402abc4b2a76b9719d911017c592"
+	tests := []struct {
+		name   string
+		synced map[string]string // MD5 recorded at the last sync
+		total  int
+		want   runPlan
+	}{
+		{"nothing synced", nil, 2, runPlan{Files: 2, Changed: 2, UploadBytes: 10}},
+		{"one unchanged", map[string]string{"a.txt": helloMD5}, 2, runPlan{Files: 2, Changed: 1, UploadBytes: 5}},
+		{"one changed", map[string]string{"a.txt": "old"}, 2, runPlan{Files: 2, Changed: 2, UploadBytes: 10}},
+		{"incremental run", nil, 100, runPlan{Files: 100, Changed: 2, UploadBytes: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, files := limitsTree(t, map[string]string{"a.txt": "hello", "b.txt": "world"})
+			state := &syncState{Files: map[string]stateEntry{}}
+			for rel, sum := range tt.synced {
+				state.set(rel, stateEntry{MD5: sum})
+			}
+			got, err := planUpload(files, tt.total, state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("planUpload() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanPull(t *testing.T) {
+	const helloMD5 = "5d41402abc4b2a76b9719d911017c592"
+	tests := []struct {
+		name   string
+		remote map[string]string
+		synced []string
+		want   runPlan
+	}{
+		{"up to date", map[string]string{"a.txt": helloMD5}, []string{"a.txt"}, runPlan{Files: 1}},
+		{"changed remotely", map[string]string{"a.txt": "new"}, []string{"a.txt"}, runPlan{Files: 1, Changed: 1}},
+		{"new remote file", map[string]string{"a.txt": helloMD5, "b.txt": "x"}, []string{"a.txt"}, runPlan{Files: 2, Changed: 1}},
+		{"folders are not counted", map[string]string{"a.txt": helloMD5, "dir": ""}, []string{"a.txt"}, runPlan{Files: 2}},
+		{"deleted remotely", map[string]string{}, []string{"a.txt"}, runPlan{Files: 1, Deletes: 1}},
+		{"never synced local file", map[string]string{}, nil, runPlan{Files: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, files := limitsTree(t, map[string]string{"a.txt": "hello"})
+			local := map[string]File{}
+			for _, f := range files {
+				local[filepath.ToSlash(f.Name)] = f
+			}
+			state := &syncState{Files: map[string]stateEntry{}}
+			for _, rel := range tt.synced {
+				state.set(rel, stateEntry{MD5: helloMD5})
+			}
+			got, err := planPull(tt.remote, local, state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("planPull() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
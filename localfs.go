@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// localBackend is a directory on a local or mounted file system.
+type localBackend struct {
+	root string
+}
+
+var _ backend = (*localBackend)(nil)
+
+// newLocalBackend opens the directory at root as a backend.
+func newLocalBackend(root string) (*localBackend, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &localBackend{root: root}, nil
+}
+
+func (l *localBackend) String() string { return l.root }
+
+// list hashes every regular file below the root. Unlike listLocalFiles it
+// leaves the hash cache and scan errors of the synced folders alone, and
+// an unreadable entry fails the listing, since a pull would otherwise
+// take the files in it for deleted.
+func (l *localBackend) list() (map[string]remoteObject, error) {
+	objects := map[string]remoteObject{}
+	err := filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != l.root && isInternalPath(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := fileMD5(p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		objects[rel] = remoteObject{ID: rel, MD5: sum, Size: info.Size(), ModTime: info.ModTime()}
+		return nil
+	})
+	return objects, err
+}
+
+// mkdirs does nothing; upload creates the folders it needs.
+func (l *localBackend) mkdirs(dirs []string) error { return nil }
+
+func (l *localBackend) upload(localPath, rel string) (remoteObject, error) {
+	sum, err := hashes.md5(localPath)
+	if err != nil {
+		return remoteObject{}, err
+	}
+	dest := filepath.Join(l.root, filepath.FromSlash(rel))
+	existing, err := os.Stat(dest)
+	existed := err == nil
+	if existed && existing.Mode().IsRegular() {
+		if current, err := fileMD5(dest); err == nil && current == sum {
+			fmt.Printf("%s is up to date.\n", rel)
+			return remoteObject{ID: rel, MD5: sum, Size: existing.Size(), ModTime: existing.ModTime()}, nil
+		}
+	}
+
+	fmt.Printf("Uploading %s to %s...\n", rel, l)
+	if err := copyLocalFile(localPath, dest); err != nil {
+		return remoteObject{}, err
+	}
+	undo := journalEntry{Action: actionCreate, Path: rel, Remote: "file://" + l.root}
+	if existed {
+		undo.Action = actionUpdate
+	}
+	journal.record(undo)
+	info, err := os.Stat(dest)
+	if err != nil {
+		return remoteObject{}, err
+	}
+	return remoteObject{ID: rel, MD5: sum, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// setMetadata ignores metadata; plain directories have nowhere to keep it.
+func (l *localBackend) setMetadata(localPath string, obj remoteObject, meta fileMetadata) error {
+	return nil
+}
+
+func (l *localBackend) flush() int { return 0 }
+
+func (l *localBackend) download(obj remoteObject, localPath string) error {
+	return copyLocalFile(filepath.Join(l.root, filepath.FromSlash(obj.ID)), localPath)
+}
+
+func (l *localBackend) openRevision(obj remoteObject, revisionID string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("%s keeps no revisions", l)
+}
+
+func (l *localBackend) remove(rel string) error {
+	return os.Remove(filepath.Join(l.root, filepath.FromSlash(rel)))
+}
+
+// copyLocalFile copies src to dest through a temporary file next to dest
+// and keeps the modification time of src.
+func copyLocalFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".gdrivesync-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
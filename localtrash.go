@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// localTrashDir holds local files removed or overwritten by a pull,
+	// inside the local sync folder.
+	localTrashDir = ".gdrivesync-trash"
+	// localTrashStamp names the per-run directories inside the trash.
+	localTrashStamp = "20060102T150405.000000000"
+)
+
+// localTrashItem is a file kept in the local trash.
+type localTrashItem struct {
+	TrashedAt time.Time
+	Stamp     string
+	Name      string // original path relative to the sync folder
+	Path      string // current location inside the trash
+}
+
+// moveToLocalTrash moves a file out of the way into the local trash of
+// root, keeping its path relative to root below the directory of the run,
+// named stamp (see syncState.trashStamp).
+func moveToLocalTrash(root, stamp, name string) error {
+	dest := filepath.Join(root, localTrashDir, stamp, name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(root, name), dest)
+}
+
+// listLocalTrash returns the contents of the local trash, oldest first.
+func listLocalTrash(root string) ([]localTrashItem, error) {
+	trash := filepath.Join(root, localTrashDir)
+	stamps, err := os.ReadDir(trash)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var items []localTrashItem
+	for _, stamp := range stamps {
+		trashedAt, err := time.Parse(localTrashStamp, stamp.Name())
+		if err != nil || !stamp.IsDir() {
+			continue
+		}
+		stampDir := filepath.Join(trash, stamp.Name())
+		err = filepath.Walk(stampDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(stampDir, path)
+			if err != nil {
+				return err
+			}
+			items = append(items, localTrashItem{TrashedAt: trashedAt, Stamp: stamp.Name(), Name: rel, Path: path})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].TrashedAt.Before(items[j].TrashedAt) })
+	return items, nil
+}
+
+// restoreFromLocalTrash moves the most recently trashed copy of each name
+// back to its original location.
+func restoreFromLocalTrash(root string, names []string, overwrite bool) error {
+	items, err := listLocalTrash(root)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		name = filepath.Clean(name)
+		var latest *localTrashItem
+		for i := range items {
+			if items[i].Name == name || items[i].Stamp+string(filepath.Separator)+items[i].Name == name {
+				latest = &items[i]
+			}
+		}
+		if latest == nil {
+			log.Printf("No trashed copy of %s\n", name)
+			continue
+		}
+
+		dest := filepath.Join(root, latest.Name)
+		if _, err := os.Lstat(dest); err == nil && !overwrite {
+			return fmt.Errorf("%s already exists, use -overwrite to replace it", latest.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		fmt.Printf("Restoring %s trashed at %s...\n", latest.Name, latest.TrashedAt.Local().Format(time.RFC3339))
+		if err := os.Rename(latest.Path, dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeLocalTrash deletes everything trashed longer ago than retention.
+func purgeLocalTrash(root string, retention time.Duration, dryRun bool) error {
+	trash := filepath.Join(root, localTrashDir)
+	stamps, err := os.ReadDir(trash)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	for _, stamp := range stamps {
+		trashedAt, err := time.Parse(localTrashStamp, stamp.Name())
+		if err != nil || trashedAt.After(cutoff) {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("Would purge %s\n", stamp.Name())
+			continue
+		}
+		fmt.Printf("Purging %s...\n", stamp.Name())
+		if err := os.RemoveAll(filepath.Join(trash, stamp.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runLocalTrash implements the localtrash subcommands. They work on the
+// local folder of the pair selected with -pair.
+func runLocalTrash(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: gdrivesync localtrash list|restore|purge [-pair name] [flags]")
+	}
+
+	flags := flag.NewFlagSet("localtrash "+args[0], flag.ExitOnError)
+	pairName := pairFlag(flags)
+	switch args[0] {
+	case "list":
+		flags.Parse(args[1:])
+		root := findSyncPair(*pairName).Local
+		items, err := listLocalTrash(root)
+		if err != nil {
+			log.Fatalf("Unable to list local trash: %v", err)
+		}
+		for _, item := range items {
+			fmt.Printf("%s  %s\n", item.TrashedAt.Local().Format(time.RFC3339), item.Name)
+		}
+		fmt.Printf("%d trashed files.\n", len(items))
+
+	case "restore":
+		overwrite := flags.Bool("overwrite", false, "replace files that exist again")
+		flags.Parse(args[1:])
+		if flags.NArg() == 0 {
+			log.Fatal("Usage: gdrivesync localtrash restore [-pair name] [-overwrite] <path>...")
+		}
+		root := findSyncPair(*pairName).Local
+		if err := restoreFromLocalTrash(root, flags.Args(), *overwrite); err != nil {
+			log.Fatalf("Error restoring from local trash: %v", err)
+		}
+
+	case "purge":
+		retention := flags.Duration("older-than", localTrashRetention(), "only purge files trashed longer ago than this")
+		dryRun := flags.Bool("dry-run", false, "only show what would be purged")
+		flags.Parse(args[1:])
+		root := findSyncPair(*pairName).Local
+		if err := purgeLocalTrash(root, *retention, *dryRun); err != nil {
+			log.Fatalf("Error purging local trash: %v", err)
+		}
+
+	default:
+		log.Fatalf("Unknown localtrash command %q", args[0])
+	}
+}
+
+// localTrashRetention is how long trashed local files are kept, from
+// GDRIVESYNC_LOCAL_TRASH_RETENTION (default 30 days).
+func localTrashRetention() time.Duration {
+	return envDuration("GDRIVESYNC_LOCAL_TRASH_RETENTION", 30*24*time.Hour)
+}
+
+// isInternalPath reports whether a path relative to the sync folder belongs
+// to gdrivesync itself and must never be synced.
+func isInternalPath(rel string) bool {
+	first := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+	return first == localTrashDir || first == localMetaDir || first == localQuarantineDir
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// App properties recording who checked out a Drive file.
+const (
+	lockHolderProperty  = "lock.holder"
+	lockHostProperty    = "lock.host"
+	lockTimeProperty    = "lock.time"
+	lockExpiresProperty = "lock.expires"
+)
+
+// lockFileFields are the file fields needed to check and change a lock.
+const lockFileFields = "id, name, mimeType, appProperties, contentRestrictions"
+
+// lockSettleDelay is how long a new lock is left to settle before it is
+// read back, so a competing lock written at the same time shows up.
+const lockSettleDelay = 2 * time.Second
+
+// fileLock is the check-out recorded on a Drive file.
+type fileLock struct {
+	Holder  string
+	Host    string
+	Time    time.Time
+	Expires time.Time
+}
+
+// lockOf returns the lock of a Drive file, or nil if it is not checked out.
+func lockOf(file *drive.File) *fileLock {
+	holder := file.AppProperties[lockHolderProperty]
+	if holder == "" {
+		return nil
+	}
+	l := &fileLock{Holder: holder, Host: file.AppProperties[lockHostProperty]}
+	l.Time, _ = time.Parse(time.RFC3339, file.AppProperties[lockTimeProperty])
+	l.Expires, _ = time.Parse(time.RFC3339, file.AppProperties[lockExpiresProperty])
+	return l
+}
+
+// expired reports whether the lock may be broken by someone else.
+func (l *fileLock) expired() bool {
+	return !l.Expires.IsZero() && time.Now().After(l.Expires)
+}
+
+// ownedBy reports whether account holds the lock.
+func (l *fileLock) ownedBy(account string) bool {
+	return l.Holder == account
+}
+
+func (l *fileLock) String() string {
+	return fmt.Sprintf("%s on %s since %s", l.Holder, l.Host, l.Time.Local().Format(time.RFC3339))
+}
+
+// lockAccount returns the account locks are taken for. It fails if the
+// Drive account is not known, since every such process would otherwise
+// own the same locks.
+func lockAccount() (string, error) {
+	if audit == nil || audit.account == "" || audit.account == unknownAccount {
+		return "", fmt.Errorf("the Drive account is unknown")
+	}
+	return audit.account, nil
+}
+
+// checkLock returns an error if file is checked out by another account.
+// Expired locks still block a sync until they are broken explicitly.
+func checkLock(file *drive.File) error {
+	l := lockOf(file)
+	if l == nil {
+		return nil
+	}
+	if account, err := lockAccount(); err != nil || !l.ownedBy(account) {
+		return fmt.Errorf("%s is checked out by %s", file.Name, l)
+	}
+	return nil
+}
+
+// setReadOnly sets or lifts the read-only content restriction of a file.
+func setReadOnly(service *drive.Service, fileID string, readOnly bool, reason string) error {
+	restriction := &drive.ContentRestriction{ReadOnly: readOnly, Reason: reason, ForceSendFields: []string{"ReadOnly"}}
+	_, err := service.Files.Update(fileID, &drive.File{ContentRestrictions: []*drive.ContentRestriction{restriction}}).Fields("id").Do()
+	return err
+}
+
+// lockReason is the content restriction reason shown in Drive.
+func lockReason(holder, host string) string {
+	return fmt.Sprintf("Checked out by %s on %s", holder, host)
+}
+
+// lockDriveFile checks out a Drive file for this account until ttl has
+// passed. A lock held by someone else is only replaced when it has
+// expired and breakExpired is set. Drive cannot update a file
+// conditionally, so the lock is read back after it settled and given up
+// if a competing lock overwrote it.
+func lockDriveFile(service *drive.Service, rel string, file *drive.File, ttl time.Duration, breakExpired bool) error {
+	account, err := lockAccount()
+	if err != nil {
+		return err
+	}
+	if l := lockOf(file); l != nil && !l.ownedBy(account) {
+		if !l.expired() {
+			return fmt.Errorf("checked out by %s until %s", l, l.Expires.Local().Format(time.RFC3339))
+		}
+		if !breakExpired {
+			return fmt.Errorf("expired lock held by %s, use -break to take it over", l)
+		}
+		fmt.Printf("Breaking expired lock of %s held by %s...\n", rel, l)
+	}
+
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	patch := &drive.File{
+		AppProperties: map[string]string{
+			lockHolderProperty:  account,
+			lockHostProperty:    host,
+			lockTimeProperty:    now.Format(time.RFC3339),
+			lockExpiresProperty: now.Add(ttl).Format(time.RFC3339),
+		},
+		ContentRestrictions: []*drive.ContentRestriction{{ReadOnly: true, Reason: lockReason(account, host)}},
+	}
+	_, err = service.Files.Update(file.Id, patch).Fields("id").Do()
+	audit.record("lock", rel, file.Id, "", err)
+	if err != nil {
+		return err
+	}
+	journal.record(lockUndoEntry(rel, file, patch.AppProperties))
+
+	time.Sleep(lockSettleDelay)
+	current, err := service.Files.Get(file.Id).Fields(lockFileFields).Do()
+	if err != nil {
+		return fmt.Errorf("verifying lock: %v", err)
+	}
+	if l := lockOf(current); l == nil || !l.ownedBy(account) || l.Host != host || !l.Time.Equal(now.Truncate(time.Second)) {
+		if l == nil {
+			return fmt.Errorf("lock was released by someone else")
+		}
+		return fmt.Errorf("lost the lock to %s", l)
+	}
+	fmt.Printf("Checked out %s until %s.\n", rel, now.Add(ttl).Local().Format(time.RFC3339))
+	return nil
+}
+
+// unlockDriveFile checks a Drive file back in. Only the holder may do so,
+// unless the lock has expired and breakExpired is set.
+func unlockDriveFile(service *drive.Service, rel string, file *drive.File, breakExpired bool) error {
+	l := lockOf(file)
+	if l == nil {
+		return fmt.Errorf("not checked out")
+	}
+	account, err := lockAccount()
+	if err != nil {
+		return err
+	}
+	if !l.ownedBy(account) {
+		if !l.expired() {
+			return fmt.Errorf("checked out by %s until %s", l, l.Expires.Local().Format(time.RFC3339))
+		}
+		if !breakExpired {
+			return fmt.Errorf("expired lock held by %s, use -break to release it", l)
+		}
+		fmt.Printf("Breaking expired lock of %s held by %s...\n", rel, l)
+	}
+
+	patch := &drive.File{
+		ContentRestrictions: []*drive.ContentRestriction{{ReadOnly: false, ForceSendFields: []string{"ReadOnly"}}},
+		NullFields: []string{
+			"AppProperties." + lockHolderProperty,
+			"AppProperties." + lockHostProperty,
+			"AppProperties." + lockTimeProperty,
+			"AppProperties." + lockExpiresProperty,
+		},
+	}
+	_, err = service.Files.Update(file.Id, patch).Fields("id").Do()
+	audit.record("unlock", rel, file.Id, "", err)
+	if err != nil {
+		return err
+	}
+	journal.record(lockUndoEntry(rel, file, map[string]string{
+		lockHolderProperty: "", lockHostProperty: "", lockTimeProperty: "", lockExpiresProperty: "",
+	}))
+	fmt.Printf("Checked in %s.\n", rel)
+	return nil
+}
+
+// lockUndoEntry journals a lock change of file so undo can restore its
+// previous lock properties and read-only state.
+func lockUndoEntry(rel string, file *drive.File, changes map[string]string) journalEntry {
+	readOnly := false
+	for _, r := range file.ContentRestrictions {
+		readOnly = readOnly || r.ReadOnly
+	}
+	return journalEntry{
+		Action:            actionProperties,
+		Path:              rel,
+		DriveID:           file.Id,
+		PrevAppProperties: prevAppProperties(file.AppProperties, changes),
+		PrevReadOnly:      &readOnly,
+	}
+}
+
+// resolveDrivePath looks up a file by its slash separated path below rootID.
+func resolveDrivePath(service *drive.Service, rootID, rel string) (*drive.File, error) {
+	parentID := rootID
+	var file *drive.File
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+rel), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		query := fmt.Sprintf("name=%s and '%s' in parents and trashed=false", driveQueryString(part), parentID)
+		list, err := service.Files.List().Q(query).Fields("files(" + lockFileFields + ")").PageSize(1).Do()
+		if err != nil {
+			return nil, err
+		}
+		if len(list.Files) == 0 {
+			return nil, fmt.Errorf("%s: %w", rel, os.ErrNotExist)
+		}
+		file = list.Files[0]
+		parentID = file.Id
+	}
+	if file == nil || file.MimeType == folderMimeType {
+		return nil, fmt.Errorf("%s is not a file", rel)
+	}
+	return file, nil
+}
+
+// runLock implements the lock and unlock commands. Paths are relative to
+// the local folder of the selected sync pair.
+func runLock(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	pairName := pairFlag(flags)
+	breakExpired := flags.Bool("break", false, "take over or release an expired lock held by someone else")
+	ttl := flags.Duration("ttl", envDuration("GDRIVESYNC_LOCK_TTL", 24*time.Hour), "how long the lock lasts")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		log.Fatalf("Usage: gdrivesync %s [-pair name] [-break] [-ttl duration] <path>...", command)
+	}
+	rootID, err := findSyncPair(*pairName).driveRoot()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	service := newDriveService()
+	if journal, err = openJournal(journalDir, command); err != nil {
+		log.Fatalf("Unable to open journal: %v", err)
+	}
+	defer journal.close()
+
+	failed := 0
+	for _, rel := range flags.Args() {
+		rel = path.Clean(strings.ReplaceAll(rel, "\\", "/"))
+		file, err := resolveDrivePath(service, rootID, rel)
+		if err == nil {
+			if command == "lock" {
+				err = lockDriveFile(service, rel, file, *ttl, *breakExpired)
+			} else {
+				err = unlockDriveFile(service, rel, file, *breakExpired)
+			}
+		}
+		if err != nil {
+			log.Printf("Unable to %s %s: %v\n", command, rel, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		journal.close()
+		log.Fatalf("%d of %d files could not be %sed", failed, flags.NArg(), command)
+	}
+}
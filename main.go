@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -22,62 +26,171 @@ const (
 	tokenFile       = "token.json"
 	localFolderPath = "C:\\testsync\\"
 	gDriveFolderID  = "folder_identifier"
+
+	// uploadedFileFields are the fields fetched for uploaded files.
+	uploadedFileFields = "id, md5Checksum, size, headRevisionId, appProperties, description, starred, properties"
+)
+
+var (
+	// driveClient is the authorized HTTP client behind the Drive service,
+	// used for calls the generated client does not cover such as batches.
+	driveClient *http.Client
+	// driveLimiter is the rate limiter shared by all Drive API requests.
+	driveLimiter *rateLimiter
+	// rateLimitRetries is how often a rate limited request is sent again.
+	rateLimitRetries int
 )
 
 // File represents a local file
 type File struct {
 	Name string
 	Path string
+	// LinkOf is the name of an earlier file this one is a hard link to.
+	LinkOf string
+	// RemoteDir is the slash separated remote folder the file is uploaded
+	// into, if routing rules moved it away from its local folder.
+	RemoteDir string
+	// Size, ModTime and ChangeTime are as listed; they are zero for files
+	// that were not listed from the local folder.
+	Size       int64
+	ModTime    time.Time
+	ChangeTime time.Time
 }
 
-// uploadToGoogleDrive uploads a local file to Google Drive.
-func uploadToGoogleDrive(service *drive.Service, localFilePath, parentFolderID string) error {
+// remoteDir returns the remote folder of the file relative to the root.
+func (f File) remoteDir() string {
+	if f.RemoteDir != "" {
+		return f.RemoteDir
+	}
+	return path.Dir(filepath.ToSlash(f.Name))
+}
+
+// remotePath returns the slash separated path of the file relative to the
+// remote root.
+func (f File) remotePath() string {
+	return path.Join(f.remoteDir(), path.Base(filepath.ToSlash(f.Name)))
+}
+
+// uploadToGoogleDrive uploads a local file to Google Drive and returns the
+// resulting Drive file. Uploads rejected by a rate limit are retried.
+func uploadToGoogleDrive(service *drive.Service, localFilePath, parentFolderID string) (*drive.File, error) {
+	var uploaded *drive.File
+	err := retryRateLimited(context.Background(), func() error {
+		var err error
+		uploaded, err = uploadFileOnce(service, localFilePath, parentFolderID)
+		return err
+	})
+	return uploaded, err
+}
+
+// uploadFileOnce makes a single attempt at uploadToGoogleDrive.
+func uploadFileOnce(service *drive.Service, localFilePath, parentFolderID string) (*drive.File, error) {
 	file, err := os.Open(localFilePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
 
 	fileName := filepath.Base(localFilePath)
+	props := xattrProperties(localFilePath)
 
 	// Check if the file already exists on Google Drive
-	if existingFileID := getDriveFileID(service, fileName, parentFolderID); existingFileID != "" {
+	if existing := getDriveFile(service, fileName, parentFolderID); existing != nil {
+		changes := xattrPropertyChanges(existing.AppProperties, props)
+		patch := appPropertiesPatch(changes)
+
+		// Skip the upload when the content is unchanged
+		if sum, err := hashes.md5(localFilePath); err == nil && sum == existing.Md5Checksum {
+			if patch == nil {
+				fmt.Printf("%s is up to date.\n", fileName)
+				return existing, nil
+			}
+			if err := checkLock(existing); err != nil {
+				return nil, err
+			}
+			fmt.Printf("Updating attributes of %s on Google Drive...\n", fileName)
+			undo := journalEntry{Action: actionProperties, Path: localFilePath, DriveID: existing.Id, PrevAppProperties: prevAppProperties(existing.AppProperties, changes)}
+			if pendingMetadata.add("update-properties", localFilePath, newAppPropertiesRequest(existing.Id, changes), undo) {
+				return existing, nil
+			}
+			updated, err := service.Files.Update(existing.Id, patch).Fields(uploadedFileFields).Do()
+			audit.record("update-properties", localFilePath, existing.Id, existing.Md5Checksum, err)
+			if err == nil {
+				journal.record(undo)
+			}
+			return updated, err
+		}
+
+		if err := checkLock(existing); err != nil {
+			return nil, err
+		}
 		fmt.Printf("Updating %s on Google Drive...\n", fileName)
 
-		_, err := service.Files.Update(existingFileID, nil).Media(file).Do()
-		return err
+		// A file checked out by this account is read-only on Drive as well
+		if l := lockOf(existing); l != nil {
+			if err := setReadOnly(service, existing.Id, false, ""); err != nil {
+				return nil, err
+			}
+			defer func() {
+				if err := setReadOnly(service, existing.Id, true, lockReason(l.Holder, l.Host)); err != nil {
+					log.Printf("Unable to restore lock of %s: %v\n", fileName, err)
+				}
+			}()
+		}
+
+		updated, err := service.Files.Update(existing.Id, patch).Media(file).Fields(uploadedFileFields).Do()
+		if err != nil {
+			audit.record(actionUpdate, localFilePath, existing.Id, "", err)
+			return nil, err
+		}
+		audit.record(actionUpdate, localFilePath, updated.Id, updated.Md5Checksum, nil)
+		journal.record(journalEntry{
+			Action:            actionUpdate,
+			Path:              localFilePath,
+			DriveID:           updated.Id,
+			PrevRevisionID:    existing.HeadRevisionId,
+			PrevAppProperties: prevAppProperties(existing.AppProperties, changes),
+		})
+		return updated, nil
 	}
 
 	// File doesn't exist, create a new file
 	fmt.Printf("Uploading %s to Google Drive...\n", fileName)
 	driveFile := &drive.File{
-		Name:     fileName,
-		Parents:  []string{parentFolderID},
-		MimeType: "application/octet-stream",
+		Name:          fileName,
+		Parents:       []string{parentFolderID},
+		MimeType:      "application/octet-stream",
+		AppProperties: props,
 	}
 
-	_, err = service.Files.Create(driveFile).Media(file).Do()
-	return err
+	created, err := service.Files.Create(driveFile).Media(file).Fields(uploadedFileFields).Do()
+	if err != nil {
+		audit.record(actionCreate, localFilePath, "", "", err)
+		return nil, err
+	}
+	audit.record(actionCreate, localFilePath, created.Id, created.Md5Checksum, nil)
+	journal.record(journalEntry{Action: actionCreate, Path: localFilePath, DriveID: created.Id})
+	return created, nil
 }
 
-// getDriveFileID retrieves the ID of an existing file on Google Drive.
-func getDriveFileID(service *drive.Service, fileName, parentFolderID string) string {
-	query := fmt.Sprintf("name='%s' and '%s' in parents and trashed=false", fileName, parentFolderID)
-	files, err := service.Files.List().Q(query).Do()
+// getDriveFile retrieves the ID and checksum of an existing file on Google Drive.
+func getDriveFile(service *drive.Service, fileName, parentFolderID string) *drive.File {
+	query := fmt.Sprintf("name=%s and '%s' in parents and trashed=false", driveQueryString(fileName), parentFolderID)
+	files, err := service.Files.List().Q(query).Fields("files(" + uploadedFileFields + ")").Do()
 	if err != nil {
 		log.Printf("Error checking if file exists: %v\n", err)
-		return ""
+		return nil
 	}
 
 	if len(files.Files) > 0 {
-		return files.Files[0].Id
+		return files.Files[0]
 	}
 
-	return ""
+	return nil
 }
 
 // getTokenFromWeb uses Config to request a Token. It returns the retrieved Token.
-func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	fmt.Printf("Go to the following link in your browser then type the "+
 		"authorization code: \n%v\n", authURL)
@@ -103,7 +216,7 @@ func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 	// Wait for the authorization code
 	code := <-authCodeCh
 
-	tok, err := config.Exchange(context.Background(), code)
+	tok, err := config.Exchange(ctx, code)
 	if err != nil {
 		log.Fatalf("Unable to exchange code for token: %v", err)
 	}
@@ -112,16 +225,16 @@ func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 }
 
 // getClient uses a Context and Config to retrieve a Token then generate a Client. It returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
+func getClient(ctx context.Context, config *oauth2.Config) *http.Client {
 	tok, err := tokenFromFile()
 	if err != nil {
-		tok, err = getTokenFromWeb(config)
+		tok, err = getTokenFromWeb(ctx, config)
 		if err != nil {
 			log.Fatalf("Unable to retrieve token from web: %v", err)
 		}
 		saveToken(tok)
 	}
-	return config.Client(context.Background(), tok)
+	return config.Client(ctx, tok)
 }
 
 // tokenFromFile retrieves a Token from a local file.
@@ -164,53 +277,177 @@ func openBrowser(url string) error {
 }
 
 // listLocalFiles returns a list of files in the specified local folder.
+// Entries that cannot be read, such as directories without permission or
+// files removed during the walk, are recorded in scanErrors and skipped;
+// only a failure to read folderPath itself is returned. FIFOs, sockets and
+// devices are skipped, and with GDRIVESYNC_ONE_FILESYSTEM the walk does not
+// descend into directories on other file systems. Further names of a hard
+// linked file have LinkOf set to the first name found.
 func listLocalFiles(folderPath string) ([]File, error) {
 	var files []File
+	oneFileSystem := envBool("GDRIVESYNC_ONE_FILESYSTEM", false)
+	var rootDevice uint64
+	links := map[[2]uint64]string{}
 	err := filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == folderPath {
+				return err
+			}
+			scanErrors.add(path, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(folderPath, path)
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			relPath, err := filepath.Rel(folderPath, path)
-			if err != nil {
-				return err
+		if info.IsDir() {
+			if path == folderPath {
+				rootDevice = fileDevice(info)
+				return nil
+			}
+			if isInternalPath(relPath) {
+				return filepath.SkipDir
+			}
+			if oneFileSystem && fileDevice(info) != rootDevice {
+				fmt.Printf("Skipping %s: on a different file system\n", relPath)
+				return filepath.SkipDir
 			}
-			files = append(files, File{Name: relPath, Path: path})
+			return nil
 		}
+		if isSpecialFile(info.Mode()) {
+			fmt.Printf("Skipping %s: not a regular file\n", relPath)
+			return nil
+		}
+
+		hashes.markSeen(path)
+		file := File{Name: relPath, Path: path, Size: info.Size(), ModTime: info.ModTime(), ChangeTime: fileChangeTime(info)}
+		if info.Mode().IsRegular() && fileLinks(info) > 1 {
+			key := [2]uint64{fileDevice(info), fileInode(info)}
+			if first, ok := links[key]; ok {
+				file.LinkOf = filepath.ToSlash(first)
+			} else {
+				links[key] = relPath
+			}
+		}
+		files = append(files, file)
 		return nil
 	})
 	return files, err
 }
 
-// syncFolder uploads new or modified local files to Google Drive.
-func syncFolder(service *drive.Service, localFolderPath, parentFolderID string) error {
-	localFiles, err := listLocalFiles(localFolderPath)
-	if err != nil {
+// syncFolder uploads new or modified local files of a sync pair to its
+// backend, mirroring the local directory structure except where routing
+// rules send files elsewhere. Progress is checkpointed so an interrupted run
+// resumes with the remaining files.
+func syncFolder(b backend, pair syncPair, state *syncState) error {
+	var localFiles []File
+	cp := loadCheckpoint(pair.checkpointFile(), pair.Local, pair.Remote)
+	if cp != nil {
+		localFiles = cp.pending()
+		fmt.Printf("Resuming interrupted sync, %d files remaining.\n", len(localFiles))
+		state.resumeRun(cp.Created)
+		hashes.keepUnseen()
+	} else {
+		var err error
+		localFiles, err = listLocalFiles(pair.Local)
+		if err != nil {
+			return err
+		}
+		total := len(localFiles)
+		localFiles = changedSince(localFiles, state.since)
+		localFiles = withoutShortcuts(localFiles, state)
+		localFiles = withoutHardLinks(localFiles, state)
+		rules, err := loadRouteRules()
+		if err != nil {
+			return err
+		}
+		localFiles = routeFiles(rules, localFiles, state)
+		if limits.enabled() {
+			plan, err := planUpload(localFiles, total, state)
+			if err != nil {
+				return err
+			}
+			if err := limits.check(plan); err != nil {
+				return err
+			}
+		}
+
+		cp = newCheckpoint(pair.checkpointFile(), pair.Local, pair.Remote, localFiles)
+		if err := cp.save(); err != nil {
+			log.Printf("Unable to save checkpoint: %v\n", err)
+		}
+	}
+
+	// Create any missing folders up front
+	var dirs []string
+	for _, file := range localFiles {
+		dirs = append(dirs, file.remoteDir())
+	}
+	if err := b.mkdirs(dirs); err != nil {
 		return err
 	}
 
+	// Metadata-only updates are batched until the uploads are done
+	pendingMetadata = &metadataBatch{}
+	defer func() { pendingMetadata = nil }()
+
+	// A fixed number of workers keeps open files and pending requests bounded
 	var wg sync.WaitGroup
-	for _, localFile := range localFiles {
+	var failed atomic.Int32
+	work := make(chan File)
+	for i := 0; i < envInt("GDRIVESYNC_WORKERS", 8); i++ {
 		wg.Add(1)
-		go func(file File) {
+		go func() {
 			defer wg.Done()
-
-			// Upload the file to Google Drive (with overwrite)
-			err := uploadToGoogleDrive(service, file.Path, parentFolderID)
-			if err != nil {
-				log.Printf("Error syncing %s: %v\n", file.Name, err)
+			for file := range work {
+				if !secrets.allow(pair.Local, file) {
+					cp.markDone(file.Name)
+					continue
+				}
+
+				uploaded, err := b.upload(file.Path, file.remotePath())
+				if err != nil {
+					log.Printf("Error syncing %s: %v\n", file.Name, err)
+					failed.Add(1)
+					continue
+				}
+				rel := filepath.ToSlash(file.Name)
+				state.set(rel, uploaded.stateEntry(uploaded.MD5))
+				state.setRoute(rel, file.remotePath())
+				if err := pushSidecar(b, pair.Local, rel, uploaded); err != nil {
+					log.Printf("Error updating metadata of %s: %v\n", file.Name, err)
+				}
+				cp.markDone(file.Name)
 			}
-		}(localFile)
+		}()
 	}
-
+	for _, file := range localFiles {
+		work <- file
+	}
+	close(work)
 	wg.Wait()
+	failed.Add(int32(b.flush()))
+	if err := pushHardLinks(b, state); err != nil {
+		log.Printf("Error uploading %s: %v\n", remoteLinksFile, err)
+		failed.Add(1)
+	}
 
-	return nil
+	// Keep the checkpoint around so the failed files are retried next time
+	if n := failed.Load(); n > 0 {
+		if err := cp.save(); err != nil {
+			log.Printf("Unable to save checkpoint: %v\n", err)
+		}
+		return fmt.Errorf("%d of %d files failed to sync", n, len(localFiles))
+	}
+	return cp.remove()
 }
 
 // fileExistsOnDrive checks if a file with the given name exists in the specified Google Drive folder.
 func fileExistsOnDrive(service *drive.Service, fileName, parentFolderID string) bool {
-	query := fmt.Sprintf("name='%s' and '%s' in parents and trashed=false", fileName, parentFolderID)
+	query := fmt.Sprintf("name=%s and '%s' in parents and trashed=false", driveQueryString(fileName), parentFolderID)
 	files, err := service.Files.List().Q(query).Do()
 	if err != nil {
 		log.Printf("Error checking if file exists: %v\n", err)
@@ -220,11 +457,64 @@ func fileExistsOnDrive(service *drive.Service, fileName, parentFolderID string)
 }
 
 func main() {
+	if isGitRemoteHelper() {
+		runGitRemote(os.Args[1:])
+		return
+	}
+
+	command := "sync"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+	case "sync":
+		runSync(os.Args[2:])
+	case "rehash":
+		// Rebuild the local hash cache of every pair from scratch
+		var folders []string
+		for _, pair := range loadSyncPairs() {
+			folders = append(folders, pair.Local)
+		}
+		if err := rebuildHashCache(hashCacheFile, folders); err != nil {
+			log.Fatalf("Error rebuilding hash cache: %v", err)
+		}
+		exitOnScanErrors()
+	case "pull":
+		runPull(os.Args[2:])
+	case "watch":
+		runWatch(os.Args[2:])
+	case "undo":
+		runUndo(os.Args[2:])
+	case "audit":
+		runAudit(os.Args[2:])
+	case "mount":
+		runMount(os.Args[2:])
+	case "serve":
+		runServe(os.Args[2:])
+	case "trash":
+		runTrash(os.Args[2:])
+	case "lock", "unlock":
+		runLock(command, os.Args[2:])
+	case "localtrash":
+		runLocalTrash(os.Args[2:])
+	case "git-remote":
+		runGitRemote(os.Args[2:])
+	default:
+		log.Fatalf("Unknown command %q", command)
+	}
+}
+
+// newDriveService authorizes against Google Drive using the OAuth
+// configuration from the environment.
+func newDriveService() *drive.Service {
 	// Retrieve OAuth configuration from environment variables
 	clientID := os.Getenv("CLIENT_ID")
 	clientSecret := os.Getenv("CLIENT_SECRET")
 
-	if clientID == "" || clientSecret == "" {
+	// A Drive API emulator given by GDRIVESYNC_ENDPOINT needs no credentials
+	endpoint := os.Getenv("GDRIVESYNC_ENDPOINT")
+	if endpoint == "" && (clientID == "" || clientSecret == "") {
 		log.Fatal("Missing CLIENT_ID or CLIENT_SECRET environment variables")
 	}
 
@@ -238,19 +528,173 @@ func main() {
 		Endpoint: google.Endpoint,
 	}
 
-	client := getClient(config)
+	// Route the OAuth exchange and the Drive API through the configured transport
+	baseClient, err := newHTTPClient()
+	if err != nil {
+		log.Fatalf("Unable to configure HTTP transport: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, baseClient)
+
+	var client *http.Client
+	if endpoint != "" && clientID == "" {
+		client = &http.Client{Transport: baseClient.Transport}
+	} else {
+		client = getClient(ctx, config)
+	}
+
+	// Share one rate limiter between all workers
+	driveLimiter = newDriveLimiter()
+	client.Transport = &rateLimitedTransport{base: client.Transport, limiter: driveLimiter, retries: rateLimitRetries}
+	driveClient = client
 
 	// Use the client to interact with the Google Drive API
-	service, err := drive.NewService(context.Background(), option.WithHTTPClient(client))
+	options := []option.ClientOption{option.WithHTTPClient(client)}
+	if endpoint != "" {
+		options = append(options, option.WithEndpoint(endpoint))
+	}
+	service, err := drive.NewService(ctx, options...)
 	if err != nil {
 		log.Fatalf("Unable to create Drive service: %v", err)
 	}
 
-	// Example: Sync local folder with Google Drive
-	err = syncFolder(service, localFolderPath, gDriveFolderID)
-	if err != nil {
-		log.Fatalf("Error syncing folder: %v", err)
+	// Every mutation made through the service is audited
+	if audit, err = openAuditLog(auditFile, driveAccount(service)); err != nil {
+		log.Fatalf("Unable to open audit log: %v", err)
 	}
+	return service
+}
+
+// runSync uploads the local folder of every sync pair to its remote.
+func runSync(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	force := flags.Bool("force", false, "proceed even if the run exceeds its safety limits")
+	incremental := flags.Bool("incremental", envBool("GDRIVESYNC_INCREMENTAL", false), "only consider files changed since the last successful run")
+	flags.Parse(args)
+
+	limits = loadRunLimits(*force)
+	hashes = loadHashCache(hashCacheFile)
+
+	// Journal every change so the run can be undone
+	var err error
+	if journal, err = openJournal(journalDir, "sync"); err != nil {
+		log.Fatalf("Unable to open journal: %v", err)
+	}
+	defer journal.close()
+
+	if secrets, err = newSecretScanner(); err != nil {
+		log.Fatalf("Unable to configure secret scanning: %v", err)
+	}
+
+	driveService := lazyDriveService()
+	failed := false
+	for _, pair := range loadSyncPairs() {
+		b, err := openBackend(pair.Remote, driveService)
+		if err != nil {
+			log.Fatalf("Unable to open remote of %s: %v", pair.Name, err)
+		}
+		state := loadSyncState(pair.stateFile())
+		state.beginRun(*incremental)
+		scanErrorsBefore := scanErrors.count()
 
-	fmt.Println("Sync complete.")
+		err = syncFolder(b, pair, state)
+		if err == nil && scanErrors.count() == scanErrorsBefore {
+			state.finishRun()
+		}
+		saveRunState(state)
+		if err != nil {
+			log.Printf("Error syncing %s to %s: %v\n", pair.Local, b, err)
+			failed = true
+		}
+	}
+	secrets.report()
+	if failed {
+		journal.close()
+		scanErrors.report()
+		log.Fatal("Sync failed")
+	}
+	pruneHashCache()
+
+	fmt.Printf("Sync complete (%d Drive API requests, %d rate limited, %d scan errors).\n",
+		apiStats.requests.Load(), apiStats.throttled.Load(), scanErrors.count())
+	journal.close()
+	exitOnScanErrors()
+}
+
+// runPull downloads the remote of every sync pair into its local folder.
+func runPull(args []string) {
+	flags := flag.NewFlagSet("pull", flag.ExitOnError)
+	force := flags.Bool("force", false, "proceed even if the run exceeds its safety limits")
+	interactive := flags.Bool("interactive", false, "ask how to resolve local changes instead of trashing them")
+	flags.Parse(args)
+
+	if *interactive {
+		conflicts = &conflictQueue{}
+	}
+
+	limits = loadRunLimits(*force)
+	hashes = loadHashCache(hashCacheFile)
+
+	driveService := lazyDriveService()
+	failed := false
+	for _, pair := range loadSyncPairs() {
+		b, err := openBackend(pair.Remote, driveService)
+		if err != nil {
+			log.Fatalf("Unable to open remote of %s: %v", pair.Name, err)
+		}
+		state := loadSyncState(pair.stateFile())
+		err = pullFolder(b, pair.Local, state)
+		saveRunState(state)
+		if err != nil {
+			log.Printf("Error pulling %s from %s: %v\n", pair.Local, b, err)
+			failed = true
+			continue
+		}
+
+		if err := purgeLocalTrash(pair.Local, localTrashRetention(), false); err != nil {
+			log.Printf("Unable to purge local trash: %v\n", err)
+		}
+	}
+	if failed {
+		scanErrors.report()
+		log.Fatal("Pull failed")
+	}
+	pruneHashCache()
+
+	fmt.Printf("Pull complete (%d scan errors).\n", scanErrors.count())
+	exitOnScanErrors()
+}
+
+// lazyDriveService returns a function that authorizes against Google Drive
+// on first use, so pairs without a Drive remote need no credentials.
+func lazyDriveService() func() *drive.Service {
+	var service *drive.Service
+	return func() *drive.Service {
+		if service == nil {
+			service = newDriveService()
+		}
+		return service
+	}
+}
+
+// pruneHashCache forgets the hashes of files no pair listed during a
+// successful run. Nothing is pruned after scan errors, since the files in
+// unreadable folders were not listed.
+func pruneHashCache() {
+	if scanErrors.count() > 0 {
+		return
+	}
+	hashes.prune()
+	if err := hashes.save(); err != nil {
+		log.Printf("Unable to save hash cache: %v\n", err)
+	}
+}
+
+// saveRunState persists the hash cache and sync state at the end of a run.
+func saveRunState(state *syncState) {
+	if err := hashes.save(); err != nil {
+		log.Printf("Unable to save hash cache: %v\n", err)
+	}
+	if err := state.save(); err != nil {
+		log.Printf("Unable to save sync state: %v\n", err)
+	}
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxMergeCells bounds the LCS table of a merge; larger changes are left
+// to the user rather than risking exhausting memory.
+const maxMergeCells = 16 << 20
+
+// Conflict markers written around both versions of a conflicting region.
+const (
+	conflictOurs   = "<<<<<<< local\n"
+	conflictSep    = "=======\n"
+	conflictTheirs = ">>>>>>> remote\n"
+)
+
+// isText reports whether data looks like text that can be merged by line.
+func isText(data []byte) bool {
+	return bytes.IndexByte(data[:min(len(data), 8000)], 0) < 0 && utf8.Valid(data)
+}
+
+// splitLines splits text into lines that keep their line endings.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lcsMatches aligns b to a with a longest common subsequence and returns,
+// for every line of a, the index of the matching line of b or -1. ok is
+// false if the inputs are too large to align.
+func lcsMatches(a, b []string) (match []int, ok bool) {
+	match = make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+
+	// Common prefix and suffix need no table
+	start := 0
+	for start < len(a) && start < len(b) && a[start] == b[start] {
+		match[start] = start
+		start++
+	}
+	endA, endB := len(a), len(b)
+	for endA > start && endB > start && a[endA-1] == b[endB-1] {
+		endA--
+		endB--
+		match[endA] = endB
+	}
+
+	n, m := endA-start, endB-start
+	if n == 0 || m == 0 {
+		return match, true
+	}
+	if n*m > maxMergeCells {
+		return nil, false
+	}
+
+	// table[i][j] is the LCS length of a[start+i:endA] and b[start+j:endB]
+	table := make([][]int32, n+1)
+	for i := range table {
+		table[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[start+i] == b[start+j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else {
+				table[i][j] = max(table[i+1][j], table[i][j+1])
+			}
+		}
+	}
+	for i, j := 0, 0; i < n && j < m; {
+		switch {
+		case a[start+i] == b[start+j]:
+			match[start+i] = start + j
+			i++
+			j++
+		case table[i+1][j] >= table[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return match, true
+}
+
+// diffLines describes how b differs from a line by line: every run of
+// changes starts with a header naming its line in a, followed by the
+// removed lines prefixed with "-" and the added lines prefixed with "+".
+// ok is false if the texts are too large to compare.
+func diffLines(a, b string) (diff string, ok bool) {
+	la, lb := splitLines(a), splitLines(b)
+	match, ok := lcsMatches(la, lb)
+	if !ok {
+		return "", false
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(la) || j < len(lb) {
+		if i < len(la) && match[i] == j {
+			i++
+			j++
+			continue
+		}
+		next := i
+		for next < len(la) && match[next] < 0 {
+			next++
+		}
+		end := len(lb)
+		if next < len(la) {
+			end = match[next]
+		}
+		fmt.Fprintf(&out, "@@ line %d @@\n", i+1)
+		for _, line := range la[i:next] {
+			out.WriteString("-" + withNewline(line))
+		}
+		for _, line := range lb[j:end] {
+			out.WriteString("+" + withNewline(line))
+		}
+		i, j = next, end
+	}
+	return out.String(), true
+}
+
+// merge3 merges the changes made from base to ours and from base to theirs
+// line by line. Regions changed differently on both sides are written with
+// conflict markers and reported through conflicted. ok is false if the
+// texts are too large to merge.
+func merge3(base, ours, theirs string) (merged string, conflicted, ok bool) {
+	b, o, t := splitLines(base), splitLines(ours), splitLines(theirs)
+	matchO, ok := lcsMatches(b, o)
+	if !ok {
+		return "", false, false
+	}
+	matchT, ok := lcsMatches(b, t)
+	if !ok {
+		return "", false, false
+	}
+
+	var out strings.Builder
+	i, j, k := 0, 0, 0
+	for {
+		// Find the next base line kept unchanged on both sides
+		next := i
+		for next < len(b) && (matchO[next] < 0 || matchT[next] < 0) {
+			next++
+		}
+		endO, endT := len(o), len(t)
+		if next < len(b) {
+			endO, endT = matchO[next], matchT[next]
+		}
+
+		chunkB := strings.Join(b[i:next], "")
+		chunkO := strings.Join(o[j:endO], "")
+		chunkT := strings.Join(t[k:endT], "")
+		switch {
+		case chunkO == chunkB:
+			out.WriteString(chunkT)
+		case chunkT == chunkB, chunkO == chunkT:
+			out.WriteString(chunkO)
+		default:
+			conflicted = true
+			out.WriteString(conflictOurs)
+			out.WriteString(withNewline(chunkO))
+			out.WriteString(conflictSep)
+			out.WriteString(withNewline(chunkT))
+			out.WriteString(conflictTheirs)
+		}
+
+		if next == len(b) {
+			return out.String(), conflicted, true
+		}
+		out.WriteString(b[next])
+		i, j, k = next+1, endO+1, endT+1
+	}
+}
+
+// withNewline makes sure a non-empty chunk ends a line before a marker.
+func withNewline(s string) string {
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		return s + "\n"
+	}
+	return s
+}
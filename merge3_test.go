@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		want               string
+		conflicted         bool
+	}{
+		{"unchanged", "a\nb\n", "a\nb\n", "a\nb\n", "a\nb\n", false},
+		{"only ours", "a\nb\nc\n", "a\nB\nc\n", "a\nb\nc\n", "a\nB\nc\n", false},
+		{"only theirs", "a\nb\nc\n", "a\nb\nc\n", "a\nb\nC\n", "a\nb\nC\n", false},
+		{"both in different places", "a\nb\nc\n", "A\nb\nc\n", "a\nb\nC\n", "A\nb\nC\n", false},
+		{"same change on both sides", "a\nb\n", "a\nx\n", "a\nx\n", "a\nx\n", false},
+		{"insertions", "a\nc\n", "a\nb\nc\n", "a\nc\nd\n", "a\nb\nc\nd\n", false},
+		{"deletion and edit elsewhere", "a\nb\nc\nd\n", "a\nc\nd\n", "a\nb\nc\nD\n", "a\nc\nD\n", false},
+		{
+			"adjacent changes", "a\nb\nc\n", "a\nc\n", "a\nb\nC\n",
+			"a\n" + conflictOurs + "c\n" + conflictSep + "b\nC\n" + conflictTheirs, true,
+		},
+		{"empty base", "", "x\n", "", "x\n", false},
+		{
+			"conflicting edits", "a\nb\nc\n", "a\nours\nc\n", "a\ntheirs\nc\n",
+			"a\n" + conflictOurs + "ours\n" + conflictSep + "theirs\n" + conflictTheirs + "c\n", true,
+		},
+		{
+			"conflict without final newline", "a\nb", "a\nours", "a\ntheirs",
+			"a\n" + conflictOurs + "ours\n" + conflictSep + "theirs\n" + conflictTheirs, true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflicted, ok := merge3(tt.base, tt.ours, tt.theirs)
+			if !ok {
+				t.Fatal("merge3 refused to merge")
+			}
+			if got != tt.want || conflicted != tt.conflicted {
+				t.Errorf("merge3() = %q, %v, want %q, %v", got, conflicted, tt.want, tt.conflicted)
+			}
+		})
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{"changed line", "a\nb\nc\n", "a\nB\nc\n", "@@ line 2 @@\n-b\n+B\n"},
+		{"added at end", "a\n", "a\nb\n", "@@ line 2 @@\n+b\n"},
+		{"removed at start", "a\nb\n", "b\n", "@@ line 1 @@\n-a\n"},
+		{"two runs", "a\nb\nc\nd\n", "A\nb\nc\nD\n", "@@ line 1 @@\n-a\n+A\n@@ line 4 @@\n-d\n+D\n"},
+		{"from empty", "", "x", "@@ line 1 @@\n+x\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := diffLines(tt.a, tt.b)
+			if !ok {
+				t.Fatal("diffLines refused to compare")
+			}
+			if got != tt.want {
+				t.Errorf("diffLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsText(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{"hello\n", true},
+		{"", true},
+		{"caf\xc3\xa9", true},
+		{"bin\x00ary", false},
+		{"\xff\xfe", false},
+	}
+	for _, tt := range tests {
+		if got := isText([]byte(tt.data)); got != tt.want {
+			t.Errorf("isText(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// localMetaDir holds one JSON sidecar per synced file with the Drive
+// organization metadata a plain file cannot carry.
+const localMetaDir = ".gdrivesync-meta"
+
+// fileMetadata is the Drive metadata kept in a sidecar file.
+type fileMetadata struct {
+	Description string            `json:"description,omitempty"`
+	Starred     bool              `json:"starred,omitempty"`
+	Properties  map[string]string `json:"properties,omitempty"`
+}
+
+// metadataOf extracts the sidecar metadata from a Drive file.
+func metadataOf(file *drive.File) fileMetadata {
+	meta := fileMetadata{Description: file.Description, Starred: file.Starred}
+	if len(file.Properties) > 0 {
+		meta.Properties = file.Properties
+	}
+	return meta
+}
+
+// sidecarPath returns where the sidecar of a relative path is stored.
+func sidecarPath(root, rel string) string {
+	return filepath.Join(root, localMetaDir, filepath.FromSlash(rel)+".json")
+}
+
+// readSidecar loads the sidecar of a relative path, or nil if there is none.
+func readSidecar(root, rel string) (*fileMetadata, error) {
+	data, err := os.ReadFile(sidecarPath(root, rel))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &fileMetadata{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// writeSidecar stores metadata for a relative path. Files without any
+// metadata get no sidecar.
+func writeSidecar(root, rel string, meta fileMetadata) error {
+	path := sidecarPath(root, rel)
+	if reflect.DeepEqual(meta, fileMetadata{}) {
+		return removeSidecar(root, rel)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// removeSidecar deletes the sidecar of a relative path if it exists.
+func removeSidecar(root, rel string) error {
+	err := os.Remove(sidecarPath(root, rel))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// metadataPatch returns the update that turns the metadata in have into
+// want, or nil if they are the same.
+func metadataPatch(have, want fileMetadata) *drive.File {
+	if reflect.DeepEqual(have, want) {
+		return nil
+	}
+
+	patch := &drive.File{
+		Description:     want.Description,
+		Starred:         want.Starred,
+		Properties:      map[string]string{},
+		ForceSendFields: []string{"Description", "Starred"},
+	}
+	for k, v := range want.Properties {
+		if have.Properties[k] != v {
+			patch.Properties[k] = v
+		}
+	}
+	for k := range have.Properties {
+		if _, ok := want.Properties[k]; !ok {
+			patch.NullFields = append(patch.NullFields, "Properties."+k)
+		}
+	}
+	return patch
+}
+
+// pushSidecar applies the local sidecar of rel, if any, to its uploaded
+// object.
+func pushSidecar(b backend, root, rel string, obj remoteObject) error {
+	meta, err := readSidecar(root, rel)
+	if err != nil || meta == nil {
+		return err
+	}
+	return b.setMetadata(filepath.Join(root, filepath.FromSlash(rel)), obj, *meta)
+}
+
+// pullSidecar stores the metadata of a pulled object in the sidecar of rel.
+// Sidecars are left alone for backends that keep no metadata.
+func pullSidecar(root, rel string, obj remoteObject) error {
+	if obj.Meta == nil {
+		return nil
+	}
+	return writeSidecar(root, rel, *obj.Meta)
+}
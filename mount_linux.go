@@ -0,0 +1,299 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"google.golang.org/api/drive/v3"
+)
+
+// mountFS is the shared state of a read-only FUSE mount of a Drive folder.
+type mountFS struct {
+	service   *drive.Service
+	cache     *blockCache
+	blockSize int64
+	ttl       time.Duration
+
+	mu       sync.Mutex
+	listings map[string]dirListing
+	files    map[string]*drive.File // latest metadata of each listed file by ID
+}
+
+// dirListing is a cached folder listing.
+type dirListing struct {
+	files   map[string]*drive.File
+	fetched time.Time
+}
+
+// driveNode is a file or folder in the mount. go-fuse reuses a known inode
+// for a Drive ID on later lookups, so nodes hold only the ID and read the
+// metadata of the latest listing.
+type driveNode struct {
+	fs.Inode
+	mfs *mountFS
+	id  string
+}
+
+var (
+	_ fs.NodeLookuper  = (*driveNode)(nil)
+	_ fs.NodeReaddirer = (*driveNode)(nil)
+	_ fs.NodeGetattrer = (*driveNode)(nil)
+	_ fs.NodeOpener    = (*driveNode)(nil)
+	_ fs.NodeReader    = (*driveNode)(nil)
+)
+
+// children lists a folder lazily, reusing a listing younger than the TTL.
+func (m *mountFS) children(folderID string) (map[string]*drive.File, error) {
+	m.mu.Lock()
+	listing, ok := m.listings[folderID]
+	m.mu.Unlock()
+	if ok && time.Since(listing.fetched) < m.ttl {
+		return listing.files, nil
+	}
+
+	files := map[string]*drive.File{}
+	query := fmt.Sprintf("'%s' in parents and trashed=false", folderID)
+	pageToken := ""
+	for {
+		list, err := m.service.Files.List().Q(query).Fields("nextPageToken, files(" + driveFileFields + ")").PageToken(pageToken).PageSize(1000).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range list.Files {
+			// Only folders and files with binary content can be read
+			if f.MimeType != folderMimeType && strings.HasPrefix(f.MimeType, "application/vnd.google-apps.") {
+				continue
+			}
+			name := safeLocalName(f.Name)
+			if _, dup := files[name]; !dup {
+				files[name] = f
+			}
+		}
+		if list.NextPageToken == "" {
+			break
+		}
+		pageToken = list.NextPageToken
+	}
+
+	m.store(folderID, files)
+	return files, nil
+}
+
+// store caches a fresh listing of a folder and the metadata of its files.
+func (m *mountFS) store(folderID string, files map[string]*drive.File) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listings[folderID] = dirListing{files: files, fetched: time.Now()}
+	for _, f := range files {
+		m.files[f.Id] = f
+	}
+}
+
+// file returns the latest known metadata of a Drive file.
+func (m *mountFS) file(id string) *drive.File {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files[id]
+}
+
+// driveFile returns the current metadata of the node's Drive file.
+func (n *driveNode) driveFile() *drive.File {
+	return n.mfs.file(n.id)
+}
+
+func (n *driveNode) isDir() bool {
+	return n.driveFile().MimeType == folderMimeType
+}
+
+func (n *driveNode) fillAttr(out *fuse.Attr) {
+	file := n.driveFile()
+	out.Mode = 0444
+	if file.MimeType == folderMimeType {
+		out.Mode = 0555 | syscall.S_IFDIR
+	}
+	out.Size = uint64(file.Size)
+	out.Blocks = (out.Size + 511) / 512
+	if modTime, err := time.Parse(time.RFC3339, file.ModifiedTime); err == nil {
+		out.SetTimes(nil, &modTime, &modTime)
+	}
+}
+
+func (n *driveNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.fillAttr(&out.Attr)
+	out.SetTimeout(n.mfs.ttl)
+	return 0
+}
+
+func (n *driveNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if !n.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	files, err := n.mfs.children(n.id)
+	if err != nil {
+		log.Printf("Error listing %s: %v\n", n.driveFile().Name, err)
+		return nil, syscall.EIO
+	}
+	file, ok := files[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	child := &driveNode{mfs: n.mfs, id: file.Id}
+	child.fillAttr(&out.Attr)
+	out.SetEntryTimeout(n.mfs.ttl)
+	out.SetAttrTimeout(n.mfs.ttl)
+	mode := uint32(syscall.S_IFREG)
+	if child.isDir() {
+		mode = syscall.S_IFDIR
+	}
+	return n.NewInode(ctx, child, fs.StableAttr{Mode: mode, Ino: driveInode(file.Id)}), 0
+}
+
+func (n *driveNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	files, err := n.mfs.children(n.id)
+	if err != nil {
+		log.Printf("Error listing %s: %v\n", n.driveFile().Name, err)
+		return nil, syscall.EIO
+	}
+	entries := make([]fuse.DirEntry, 0, len(files))
+	for name, f := range files {
+		mode := uint32(syscall.S_IFREG)
+		if f.MimeType == folderMimeType {
+			mode = syscall.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: mode, Ino: driveInode(f.Id)})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *driveNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (n *driveNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	file := n.driveFile()
+	size := file.Size
+	if off >= size {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := off + int64(len(dest))
+	if end > size {
+		end = size
+	}
+
+	blockSize := n.mfs.blockSize
+	buf := dest[:0]
+	for index := off / blockSize; index*blockSize < end; index++ {
+		block, err := readBlock(n.mfs.service, n.mfs.cache, file, index, blockSize)
+		if err != nil {
+			log.Printf("Error reading %s: %v\n", file.Name, err)
+			return nil, syscall.EIO
+		}
+		lo := int64(0)
+		if index*blockSize < off {
+			lo = off - index*blockSize
+		}
+		hi := int64(len(block))
+		if index*blockSize+hi > end {
+			hi = end - index*blockSize
+		}
+		if lo < hi {
+			buf = append(buf, block[lo:hi]...)
+		}
+	}
+	return fuse.ReadResultData(buf), 0
+}
+
+// driveInode derives a stable inode number from a Drive ID.
+func driveInode(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	// 0 and ^0 are reserved by go-fuse, 1 is the root
+	return h.Sum64()>>1 | 2
+}
+
+// runMount mounts a Drive folder read-only until interrupted. It is
+// configured with GDRIVESYNC_MOUNT_TTL (metadata cache lifetime, default
+// 1m), GDRIVESYNC_MOUNT_BLOCK_SIZE (ranged read size, default 1 MiB),
+// GDRIVESYNC_MOUNT_CACHE_DIR and GDRIVESYNC_MOUNT_CACHE_SIZE (default 1 GiB).
+func runMount(args []string) {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	folderID := flags.String("folder", gDriveFolderID, "ID of the Drive folder to mount")
+	debug := flags.Bool("debug", false, "log FUSE requests")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: gdrivesync mount [-folder ID] <mountpoint>")
+	}
+
+	cacheDir := os.Getenv("GDRIVESYNC_MOUNT_CACHE_DIR")
+	if cacheDir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			log.Fatalf("Unable to locate cache directory: %v", err)
+		}
+		cacheDir = filepath.Join(userCache, "gdrivesync", "blocks")
+	}
+	cache, err := newBlockCache(cacheDir, int64(envInt("GDRIVESYNC_MOUNT_CACHE_SIZE", 1<<30)))
+	if err != nil {
+		log.Fatalf("Unable to open block cache: %v", err)
+	}
+
+	service := newDriveService()
+	root, err := service.Files.Get(*folderID).Fields(driveFileFields).Do()
+	if err != nil {
+		log.Fatalf("Unable to find folder %s: %v", *folderID, err)
+	}
+	if root.MimeType != folderMimeType {
+		log.Fatalf("%s is not a folder", *folderID)
+	}
+
+	mfs := &mountFS{
+		service:   service,
+		cache:     cache,
+		blockSize: mountBlockSize(),
+		ttl:       envDuration("GDRIVESYNC_MOUNT_TTL", time.Minute),
+		listings:  map[string]dirListing{},
+		files:     map[string]*drive.File{root.Id: root},
+	}
+	server, err := fs.Mount(flags.Arg(0), &driveNode{mfs: mfs, id: root.Id}, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:  "gdrivesync",
+			Name:    "gdrivesync",
+			Options: []string{"ro"},
+			Debug:   *debug,
+		},
+		AttrTimeout:  &mfs.ttl,
+		EntryTimeout: &mfs.ttl,
+	})
+	if err != nil {
+		log.Fatalf("Unable to mount: %v", err)
+	}
+	fmt.Printf("Mounted %s on %s, press Ctrl-C to unmount.\n", root.Name, flags.Arg(0))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := server.Unmount(); err != nil {
+			log.Printf("Unable to unmount: %v\n", err)
+		}
+	}()
+	server.Wait()
+}
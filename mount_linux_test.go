@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestMountLookupRefreshesChangedFile(t *testing.T) {
+	root := &drive.File{Id: "root", Name: "root", MimeType: folderMimeType}
+	mfs := &mountFS{ttl: time.Hour, listings: map[string]dirListing{}, files: map[string]*drive.File{root.Id: root}}
+	raw := fs.NewNodeFS(&driveNode{mfs: mfs, id: root.Id}, &fs.Options{})
+	header := &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+
+	versions := []*drive.File{
+		{Id: "f1", Name: "notes.txt", Size: 3, Md5Checksum: "aaa", ModifiedTime: "2024-01-02T03:04:05Z"},
+		{Id: "f1", Name: "notes.txt", Size: 11, Md5Checksum: "bbb", ModifiedTime: "2024-02-03T04:05:06Z"},
+	}
+	for _, file := range versions {
+		// An expired listing is fetched again; stand in for the new result
+		mfs.store(root.Id, map[string]*drive.File{file.Name: file})
+		var entry fuse.EntryOut
+		if status := raw.Lookup(nil, header, file.Name, &entry); !status.Ok() {
+			t.Fatalf("Lookup(%s) = %v", file.Name, status)
+		}
+		var attr fuse.AttrOut
+		if status := raw.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &attr); !status.Ok() {
+			t.Fatalf("GetAttr(%s) = %v", file.Name, status)
+		}
+		modTime, _ := time.Parse(time.RFC3339, file.ModifiedTime)
+		if attr.Size != uint64(file.Size) || attr.Mtime != uint64(modTime.Unix()) {
+			t.Errorf("attributes after %s = size %d mtime %d, want %d %d", file.Md5Checksum, attr.Size, attr.Mtime, file.Size, modTime.Unix())
+		}
+	}
+}
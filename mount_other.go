@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "log"
+
+// runMount is only available on Linux.
+func runMount(args []string) {
+	log.Fatal("The mount command is only supported on Linux")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// pullFolder downloads new or modified files from a backend into
+// localFolderPath and propagates deletions made on the remote. Files
+// changed only locally are left for the next sync. Local files that would
+// be deleted, or overwritten while both sides changed, are moved to the
+// local trash instead of being lost. In an interactive pull overwritten
+// files are resolved as conflicts instead.
+func pullFolder(b backend, localFolderPath string, state *syncState) error {
+	remote, err := b.list()
+	if err != nil {
+		return err
+	}
+	unrouteTree(remote, state)
+	if obj, ok := remote[remoteLinksFile]; ok {
+		delete(remote, remoteLinksFile)
+		if err := pullHardLinks(b, localFolderPath, obj, remote, state); err != nil {
+			return err
+		}
+	}
+	localFiles, err := listLocalFiles(localFolderPath)
+	if err != nil {
+		return err
+	}
+	local := make(map[string]File, len(localFiles))
+	for _, file := range localFiles {
+		local[filepath.ToSlash(file.Name)] = file
+	}
+	if limits.enabled() {
+		sums := make(map[string]string, len(remote))
+		for rel, obj := range remote {
+			sums[rel] = obj.MD5
+		}
+		plan, err := planPull(sums, local, state)
+		if err != nil {
+			return err
+		}
+		if err := limits.check(plan); err != nil {
+			return err
+		}
+	}
+
+	paths := make(map[string]string, len(remote))
+	names := make([]string, 0, len(remote))
+	for rel, obj := range remote {
+		if obj.Shortcut == "" {
+			paths[obj.ID] = rel
+		}
+		if !isInternalPath(rel) {
+			names = append(names, rel)
+		}
+	}
+	sort.Strings(names)
+
+	var failed atomic.Int32
+	var wg sync.WaitGroup
+	work := make(chan string)
+	for i := 0; i < envInt("GDRIVESYNC_WORKERS", 8); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range work {
+				var err error
+				if obj := remote[rel]; obj.Shortcut != "" {
+					err = pullShortcut(localFolderPath, rel, obj, paths, state)
+				} else {
+					err = pullFile(b, localFolderPath, rel, obj, local, state)
+				}
+				if err != nil {
+					log.Printf("Error pulling %s: %v\n", rel, err)
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	for _, rel := range names {
+		work <- rel
+	}
+	close(work)
+	wg.Wait()
+	failed.Add(int32(resolveConflicts(b, localFolderPath, state)))
+	markShortcutTargets(remote, state)
+
+	// Files that were synced before but are gone from the remote were deleted there
+	for rel := range local {
+		if _, ok := remote[rel]; ok {
+			continue
+		}
+		if entry, ok := state.get(rel); !ok || entry.LinkOf != "" {
+			continue
+		}
+		fmt.Printf("Removing %s (deleted on %s)...\n", rel, b)
+		if err := moveToLocalTrash(localFolderPath, state.trashStamp(), filepath.FromSlash(rel)); err != nil {
+			log.Printf("Error removing %s: %v\n", rel, err)
+			failed.Add(1)
+			continue
+		}
+		state.remove(rel)
+		if err := removeSidecar(localFolderPath, rel); err != nil {
+			log.Printf("Error removing metadata of %s: %v\n", rel, err)
+		}
+	}
+
+	restoreHardLinks(localFolderPath, state)
+
+	if n := failed.Load(); n > 0 {
+		return fmt.Errorf("%d files failed to pull", n)
+	}
+	return nil
+}
+
+// pullFile brings a single local path up to date with its remote object.
+func pullFile(b backend, root, rel string, obj remoteObject, local map[string]File, state *syncState) error {
+	localPath := filepath.Join(root, filepath.FromSlash(rel))
+	if obj.Folder {
+		return os.MkdirAll(localPath, 0755)
+	}
+
+	if lf, ok := local[rel]; ok {
+		sum, err := hashes.md5(lf.Path)
+		if err != nil {
+			return err
+		}
+		if upToDate(obj, sum, rel, state) {
+			restoreXattrs(localPath, obj.Xattrs)
+			state.set(rel, obj.stateEntry(sum))
+			return pullSidecar(root, rel, obj)
+		}
+
+		// Changes made only locally are left for the next sync to upload
+		entry, synced := state.get(rel)
+		if synced && entry.MD5 != sum && upToDate(obj, entry.MD5, rel, state) {
+			return nil
+		}
+
+		// Keep local content that was never synced before replacing it
+		if !synced || entry.MD5 != sum {
+			if conflicts.add(conflict{Rel: rel, Object: obj}) {
+				return nil
+			}
+			fmt.Printf("Moving modified %s to the local trash...\n", rel)
+			if err := moveToLocalTrash(root, state.trashStamp(), filepath.FromSlash(rel)); err != nil {
+				return err
+			}
+		}
+	}
+	return fetchObject(b, root, rel, obj, state)
+}
+
+// fetchObject downloads a remote object to rel below root, restoring its
+// modification time, attributes and metadata, and records it as synced.
+func fetchObject(b backend, root, rel string, obj remoteObject, state *syncState) error {
+	fmt.Printf("Downloading %s...\n", rel)
+	localPath := filepath.Join(root, filepath.FromSlash(rel))
+	if err := b.download(obj, localPath); err != nil {
+		return err
+	}
+	if !obj.ModTime.IsZero() {
+		os.Chtimes(localPath, obj.ModTime, obj.ModTime)
+	}
+	restoreXattrs(localPath, obj.Xattrs)
+	sum := obj.MD5
+	if sum == "" {
+		var err error
+		if sum, err = hashes.md5(localPath); err != nil {
+			return err
+		}
+	}
+	state.set(rel, obj.stateEntry(sum))
+	return pullSidecar(root, rel, obj)
+}
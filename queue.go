@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const changeQueueFile = "queue.json"
+
+// queuedChange is a local file waiting to be uploaded.
+type queuedChange struct {
+	Path     string    `json:"path"` // slash separated, relative to the sync folder
+	Detected time.Time `json:"detected"`
+	// Attempts counts failed uploads; the next one is due at RetryAt.
+	Attempts int        `json:"attempts,omitempty"`
+	RetryAt  *time.Time `json:"retryAt,omitempty"`
+}
+
+// Delays between attempts to upload a change that failed.
+const (
+	queueRetryDelay    = 5 * time.Second
+	queueMaxRetryDelay = time.Hour
+)
+
+// changeQueue is an on-disk queue of local changes that could not be
+// uploaded yet, in the order they were detected. A path is queued at most
+// once; a later change moves it to the end.
+type changeQueue struct {
+	mu      sync.Mutex
+	file    string
+	Changes []queuedChange `json:"changes"`
+}
+
+// loadChangeQueue reads the queue left behind by an earlier run. A missing
+// queue is treated as empty.
+func loadChangeQueue(file string) *changeQueue {
+	q := &changeQueue{file: file}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Unable to read change queue: %v\n", err)
+		}
+		return q
+	}
+	if err := json.Unmarshal(data, q); err != nil {
+		log.Fatalf("Corrupt change queue %s: %v", file, err)
+	}
+	return q
+}
+
+// push queues a change to rel, replacing an earlier change to it.
+func (q *changeQueue) push(rel string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, c := range q.Changes {
+		if c.Path == rel {
+			q.Changes = append(q.Changes[:i], q.Changes[i+1:]...)
+			break
+		}
+	}
+	q.Changes = append(q.Changes, queuedChange{Path: rel, Detected: time.Now()})
+}
+
+// due returns the changes that are not waiting for a retry, oldest first.
+func (q *changeQueue) due(now time.Time) []queuedChange {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var changes []queuedChange
+	for _, c := range q.Changes {
+		if c.RetryAt == nil || !c.RetryAt.After(now) {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// retry keeps a change that failed to replay and schedules its next
+// attempt, doubling the delay after every failure up to
+// queueMaxRetryDelay. A path that changed again meanwhile is left alone.
+func (q *changeQueue) retry(c queuedChange) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, queued := range q.Changes {
+		if queued.Path != c.Path || !queued.Detected.Equal(c.Detected) {
+			continue
+		}
+		delay := queueRetryDelay
+		for n := 0; n < queued.Attempts && delay < queueMaxRetryDelay; n++ {
+			delay *= 2
+		}
+		delay = min(delay, queueMaxRetryDelay)
+		retryAt := time.Now().Add(delay)
+		q.Changes[i].Attempts++
+		q.Changes[i].RetryAt = &retryAt
+		return delay
+	}
+	return 0
+}
+
+// done removes a replayed change unless the path changed again meanwhile.
+func (q *changeQueue) done(c queuedChange) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, queued := range q.Changes {
+		if queued.Path == c.Path && queued.Detected.Equal(c.Detected) {
+			q.Changes = append(q.Changes[:i], q.Changes[i+1:]...)
+			return
+		}
+	}
+}
+
+// len returns the number of queued changes.
+func (q *changeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.Changes)
+}
+
+// save writes the queue to disk.
+func (q *changeQueue) save() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	tmp := q.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.file)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func queuedPaths(changes []queuedChange) []string {
+	var paths []string
+	for _, c := range changes {
+		paths = append(paths, c.Path)
+	}
+	return paths
+}
+
+func TestChangeQueue(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(q *changeQueue)
+		want []string
+	}{
+		{"empty", func(q *changeQueue) {}, nil},
+		{"in order", func(q *changeQueue) {
+			q.push("a")
+			q.push("b")
+		}, []string{"a", "b"}},
+		{"change again moves to end", func(q *changeQueue) {
+			q.push("a")
+			q.push("b")
+			q.push("a")
+		}, []string{"b", "a"}},
+		{"done", func(q *changeQueue) {
+			q.push("a")
+			q.push("b")
+			q.done(q.due(time.Now())[0])
+		}, []string{"b"}},
+		{"done after changing again", func(q *changeQueue) {
+			q.push("a")
+			c := q.due(time.Now())[0]
+			time.Sleep(time.Millisecond)
+			q.push("a")
+			q.done(c)
+		}, []string{"a"}},
+		{"failed change is kept", func(q *changeQueue) {
+			q.push("a")
+			q.push("b")
+			q.retry(q.due(time.Now())[0])
+		}, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "queue.json")
+			q := loadChangeQueue(file)
+			tt.run(q)
+			if err := q.save(); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded := loadChangeQueue(file)
+			if got := queuedPaths(loaded.Changes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("queue after reload = %v, want %v", got, tt.want)
+			}
+			for i, c := range q.Changes {
+				got := loaded.Changes[i]
+				if !got.Detected.Equal(c.Detected) || got.Attempts != c.Attempts || (got.RetryAt == nil) != (c.RetryAt == nil) {
+					t.Errorf("change %d reloaded as %+v, want %+v", i, got, c)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeQueueRetry(t *testing.T) {
+	q := loadChangeQueue(filepath.Join(t.TempDir(), "queue.json"))
+	q.push("a")
+	q.push("b")
+	now := time.Now()
+
+	want := []time.Duration{queueRetryDelay, 2 * queueRetryDelay, 4 * queueRetryDelay}
+	for i, delay := range want {
+		c := q.Changes[0]
+		if got := q.retry(c); got != delay {
+			t.Errorf("retry %d delay = %v, want %v", i+1, got, delay)
+		}
+	}
+	if got := queuedPaths(q.due(now)); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("due now = %v, want [b]", got)
+	}
+	if got := queuedPaths(q.due(now.Add(time.Hour))); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("due later = %v, want [a b]", got)
+	}
+
+	// A new change to the path is due at once
+	q.push("a")
+	if got := queuedPaths(q.due(now)); !reflect.DeepEqual(got, []string{"b", "a"}) {
+		t.Errorf("due after change = %v, want [b a]", got)
+	}
+}
+
+func TestChangeQueueRetryDelayIsCapped(t *testing.T) {
+	q := loadChangeQueue(filepath.Join(t.TempDir(), "queue.json"))
+	q.push("a")
+	var delay time.Duration
+	for i := 0; i < 20; i++ {
+		delay = q.retry(q.Changes[0])
+	}
+	if delay != queueMaxRetryDelay {
+		t.Errorf("delay after 20 failures = %v, want %v", delay, queueMaxRetryDelay)
+	}
+}
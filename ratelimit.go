@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// minQPS is the floor adaptive backoff never goes below.
+const minQPS = 0.5
+
+// rateLimiter is a token bucket shared by all workers. Its rate halves
+// whenever Drive reports a rate limit error and creeps back towards the
+// configured rate as requests succeed.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // current tokens per second
+	maxRate float64 // configured tokens per second
+	burst   float64
+	tokens  float64
+	last    time.Time
+}
+
+// newRateLimiter creates a limiter allowing qps requests per second with
+// bursts of up to burst requests.
+func newRateLimiter(qps float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    qps,
+		maxRate: qps,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+// wait blocks until a request may be sent or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	// Reserve a token, possibly going into debt, and sleep off the debt
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	return sleepContext(ctx, delay)
+}
+
+// sleepContext pauses for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backoff halves the rate after a rate limit error.
+func (l *rateLimiter) backoff() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate /= 2
+	if l.rate < minQPS {
+		l.rate = minQPS
+	}
+	// Drop any accumulated burst so the slower rate takes effect at once
+	if l.tokens > 0 {
+		l.tokens = 0
+	}
+}
+
+// succeed nudges the rate back up after a successful request.
+func (l *rateLimiter) succeed() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate < l.maxRate {
+		l.rate += l.maxRate / 100
+		if l.rate > l.maxRate {
+			l.rate = l.maxRate
+		}
+	}
+}
+
+// apiStats counts the Drive API requests made during a run.
+var apiStats struct {
+	requests  atomic.Int64
+	throttled atomic.Int64
+}
+
+// rateLimitedTransport sends every Drive API request through a shared
+// rate limiter and adapts the rate to rate limit errors. Rate limited
+// requests are sent again up to retries times.
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+	retries int
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		if t.limiter != nil {
+			if err := t.limiter.wait(req.Context()); err != nil {
+				// A RoundTripper closes the body even when it fails
+				if req.Body != nil {
+					req.Body.Close()
+				}
+				return nil, err
+			}
+		}
+		apiStats.requests.Add(1)
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+		if !isRateLimited(resp) {
+			if resp.StatusCode < 400 && t.limiter != nil {
+				t.limiter.succeed()
+			}
+			return resp, nil
+		}
+		apiStats.throttled.Add(1)
+		if t.limiter != nil {
+			t.limiter.backoff()
+		}
+
+		// Send the request again unless its body cannot be rewound, in
+		// which case the caller has to retry (see retryRateLimited)
+		if attempt >= t.retries || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+			return resp, nil
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, nil
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		resp.Body.Close()
+		if err := sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// isRateLimitError reports whether a failed Drive call was rejected by a
+// rate limit.
+func isRateLimitError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// retryRateLimited calls fn again with exponential backoff while it fails
+// with a rate limit error, up to rateLimitRetries times or until ctx is
+// done. It covers calls such as uploads whose body the transport cannot
+// replay.
+func retryRateLimited(ctx context.Context, fn func() error) error {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= rateLimitRetries || !isRateLimitError(err) {
+			return err
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// isRateLimited reports whether a response is a Drive rate limit error.
+// Drive signals these as 429 or as 403 with a rateLimitExceeded or
+// userRateLimitExceeded reason, so 403 bodies are inspected and restored.
+func isRateLimited(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		if err != nil {
+			return false
+		}
+		return bytes.Contains(body, []byte("rateLimitExceeded")) ||
+			bytes.Contains(body, []byte("userRateLimitExceeded"))
+	}
+	return false
+}
+
+// newDriveLimiter creates the limiter from GDRIVESYNC_QPS (default 10) and
+// GDRIVESYNC_BURST (default 20). A rate of 0 disables limiting. It also
+// sets rateLimitRetries from GDRIVESYNC_RATE_LIMIT_RETRIES (default 5).
+func newDriveLimiter() *rateLimiter {
+	rateLimitRetries = envInt("GDRIVESYNC_RATE_LIMIT_RETRIES", 5)
+	qps := envFloat("GDRIVESYNC_QPS", 10)
+	if qps <= 0 {
+		return nil
+	}
+	return newRateLimiter(qps, envInt("GDRIVESYNC_BURST", 20))
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const routeRulesFile = "rules.json"
+
+// routeRule sends matching files to another remote folder. All conditions
+// that are set must match. Dest is a folder path relative to the remote
+// root and may use the variables
+//
+//	{year} {month} {day}  when the file was taken (EXIF) or last modified
+//	{hostname}            this machine
+//	{ext}                 extension without the dot, lower case
+//	{name} {stem}         file name with and without extension
+//	{dir}                 the folder of the file relative to the sync folder
+//
+// A rule with Skip set keeps matching files from being uploaded, and one
+// with neither Dest nor Skip leaves them where they are.
+type routeRule struct {
+	Glob    string `json:"glob,omitempty"`
+	Regex   string `json:"regex,omitempty"`
+	MinSize int64  `json:"minSize,omitempty"`
+	MaxSize int64  `json:"maxSize,omitempty"`
+	MIME    string `json:"mime,omitempty"`
+	Dest    string `json:"dest,omitempty"`
+	Skip    bool   `json:"skip,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// routeVariable finds template variables in Dest.
+var routeVariable = regexp.MustCompile(`\{[^}]*\}`)
+
+// routeVariables are the variables Dest may use.
+var routeVariables = map[string]bool{
+	"{year}": true, "{month}": true, "{day}": true, "{hostname}": true,
+	"{ext}": true, "{name}": true, "{stem}": true, "{dir}": true,
+}
+
+// loadRouteRules reads the ordered routing rules from GDRIVESYNC_RULES
+// (default rules.json). A missing file means no rules.
+func loadRouteRules() ([]routeRule, error) {
+	file := envString("GDRIVESYNC_RULES", routeRulesFile)
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []routeRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("corrupt rules %s: %v", file, err)
+	}
+	for i := range rules {
+		r := &rules[i]
+		if r.Glob != "" {
+			if _, err := path.Match(r.Glob, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid glob %q", i+1, r.Glob)
+			}
+		}
+		if r.Regex != "" {
+			if r.re, err = regexp.Compile(r.Regex); err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
+			}
+		}
+		for _, v := range routeVariable.FindAllString(r.Dest, -1) {
+			if !routeVariables[v] {
+				return nil, fmt.Errorf("rule %d: unknown variable %s", i+1, v)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// matches reports whether the file at rel satisfies every condition set
+// on the rule. Globs without a slash match the file name only.
+func (r *routeRule) matches(file File, rel string, info os.FileInfo) bool {
+	if r.Glob != "" {
+		name := rel
+		if !strings.Contains(r.Glob, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(r.Glob, name); !ok {
+			return false
+		}
+	}
+	if r.re != nil && !r.re.MatchString(rel) {
+		return false
+	}
+	if r.MinSize > 0 && info.Size() < r.MinSize {
+		return false
+	}
+	if r.MaxSize > 0 && info.Size() > r.MaxSize {
+		return false
+	}
+	if r.MIME != "" {
+		if ok, _ := path.Match(r.MIME, fileMIMEType(file.Path)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// fileMIMEType guesses the MIME type of a local file from its extension
+// or, failing that, its first bytes.
+func fileMIMEType(localPath string) string {
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(localPath))); t != "" {
+		t, _, _ = strings.Cut(t, ";")
+		return t
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	t, _, _ := strings.Cut(http.DetectContentType(head[:n]), ";")
+	return t
+}
+
+// routeFile returns the remote folder, relative to the remote root, that
+// a local file is uploaded into according to the first matching rule.
+// skip is true if the file must not be uploaded.
+func routeFile(rules []routeRule, file File) (dir string, skip bool, err error) {
+	rel := filepath.ToSlash(file.Name)
+	dir = path.Dir(rel)
+	if len(rules) == 0 {
+		return dir, false, nil
+	}
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return "", false, err
+	}
+	for i := range rules {
+		r := &rules[i]
+		if !r.matches(file, rel, info) {
+			continue
+		}
+		if r.Skip {
+			return "", true, nil
+		}
+		if r.Dest == "" {
+			return dir, false, nil
+		}
+		return expandRoute(r.Dest, file, rel, info)
+	}
+	return dir, false, nil
+}
+
+// expandRoute fills in the variables of a destination template.
+func expandRoute(dest string, file File, rel string, info os.FileInfo) (string, bool, error) {
+	date := info.ModTime()
+	if strings.Contains(dest, "{year}") || strings.Contains(dest, "{month}") || strings.Contains(dest, "{day}") {
+		if taken, err := exifDate(file.Path); err == nil {
+			date = taken
+		}
+	}
+	host, _ := os.Hostname()
+	name := path.Base(rel)
+	ext := path.Ext(name)
+	expanded := strings.NewReplacer(
+		"{year}", date.Format("2006"),
+		"{month}", date.Format("01"),
+		"{day}", date.Format("02"),
+		"{hostname}", safeLocalName(host),
+		"{ext}", strings.ToLower(strings.TrimPrefix(ext, ".")),
+		"{name}", name,
+		"{stem}", strings.TrimSuffix(name, ext),
+		"{dir}", path.Dir(rel),
+	).Replace(dest)
+
+	dir := path.Clean(strings.Trim(expanded, "/"))
+	if dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", false, fmt.Errorf("destination %q leaves the remote root", expanded)
+	}
+	return dir, false, nil
+}
+
+// routeFiles sets the remote folder of each file from the rules and drops
+// the files that are skipped, cannot be routed or would collide with
+// another file on the remote.
+func routeFiles(rules []routeRule, files []File, state *syncState) []File {
+	kept := files[:0]
+	for _, file := range files {
+		dir, skip, err := routeFile(rules, file)
+		if err != nil {
+			log.Printf("Unable to route %s: %v\n", file.Name, err)
+			continue
+		}
+		if skip {
+			fmt.Printf("Skipping %s: excluded by rule\n", file.Name)
+			continue
+		}
+		file.RemoteDir = dir
+		kept = append(kept, file)
+	}
+	return claimRemotePaths(kept, state)
+}
+
+// claimRemotePaths drops files whose remote path is already taken by
+// another local file, in this run or by an earlier sync recorded in state,
+// since one would overwrite the other on the remote. Files kept in their own
+// folder claim their path before routed ones.
+func claimRemotePaths(files []File, state *syncState) []File {
+	taken := map[string]string{}
+	previous := state.remotePaths()
+	for rel, remote := range previous {
+		taken[remote] = rel
+	}
+	// Files synced in this run give up the path they went to before
+	for _, file := range files {
+		rel := filepath.ToSlash(file.Name)
+		if remote, ok := previous[rel]; ok && taken[remote] == rel {
+			delete(taken, remote)
+		}
+	}
+
+	refused := map[string]bool{}
+	for _, routed := range []bool{false, true} {
+		for _, file := range files {
+			rel := filepath.ToSlash(file.Name)
+			remote := file.remotePath()
+			if (remote != rel) != routed {
+				continue
+			}
+			if owner, ok := taken[remote]; ok && owner != rel {
+				log.Printf("Unable to route %s: %s already goes to %s\n", file.Name, owner, remote)
+				refused[rel] = true
+				continue
+			}
+			taken[remote] = rel
+		}
+	}
+
+	kept := files[:0]
+	for _, file := range files {
+		if !refused[filepath.ToSlash(file.Name)] {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
+
+// unrouteTree moves the objects of a remote tree that routing rules
+// uploaded elsewhere back to their local paths, so a pull updates them in
+// place instead of downloading a second copy. Folders that only held
+// routed files are dropped from the tree.
+func unrouteTree(tree map[string]remoteObject, state *syncState) {
+	routes := map[string]string{}
+	for rel, remote := range state.remotePaths() {
+		if remote != rel {
+			routes[rel] = remote
+		}
+	}
+	if len(routes) == 0 {
+		return
+	}
+
+	moved := map[string]remoteObject{}
+	dirs := map[string]bool{}
+	for rel, remote := range routes {
+		if obj, ok := tree[remote]; ok {
+			moved[rel] = obj
+		}
+		for dir := path.Dir(remote); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	for rel, remote := range routes {
+		delete(tree, remote)
+		delete(tree, rel)
+	}
+
+	// Keep folders that still hold something besides routed files
+	used := map[string]bool{}
+	for rel, obj := range tree {
+		if obj.Folder && dirs[rel] {
+			continue
+		}
+		for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+			used[dir] = true
+		}
+	}
+	for dir := range dirs {
+		if obj, ok := tree[dir]; ok && obj.Folder && !used[dir] {
+			delete(tree, dir)
+		}
+	}
+	for rel, obj := range moved {
+		tree[rel] = obj
+	}
+}
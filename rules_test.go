@@ -0,0 +1,234 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRouteFile(t *testing.T) {
+	root := t.TempDir()
+	modTime := time.Date(2024, 3, 7, 12, 0, 0, 0, time.Local)
+	create := func(rel string, size int) File {
+		t.Helper()
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return File{Name: filepath.FromSlash(rel), Path: path}
+	}
+	host, _ := os.Hostname()
+
+	tests := []struct {
+		name     string
+		rules    []routeRule
+		file     File
+		wantDir  string
+		wantSkip bool
+		wantErr  bool
+	}{
+		{"no rules", nil, create("docs/a.txt", 1), "docs", false, false},
+		{"no match", []routeRule{{Glob: "*.jpg", Dest: "Photos"}}, create("docs/b.txt", 1), "docs", false, false},
+		{"glob on name", []routeRule{{Glob: "*.jpg", Dest: "Photos"}}, create("camera/c.jpg", 1), "Photos", false, false},
+		{"glob with slash", []routeRule{{Glob: "camera/*", Dest: "Photos"}, {Glob: "*", Dest: "Other"}}, create("camera/d.jpg", 1), "Photos", false, false},
+		{"regex", []routeRule{{Regex: `^logs/.*\.log$`, Skip: true}}, create("logs/e.log", 1), "", true, false},
+		{"first match wins", []routeRule{{Glob: "*.txt"}, {Glob: "*", Dest: "Other"}}, create("notes/f.txt", 1), "notes", false, false},
+		{"min size", []routeRule{{MinSize: 100, Dest: "Big"}}, create("g.bin", 10), ".", false, false},
+		{"max size", []routeRule{{MaxSize: 100, Dest: "Small"}}, create("h.bin", 10), "Small", false, false},
+		{"mime", []routeRule{{MIME: "image/*", Dest: "Images"}}, create("i.png", 1), "Images", false, false},
+		{
+			"date template", []routeRule{{Glob: "*.png", Dest: "Photos/{year}/{month}-{day}"}},
+			create("j.png", 1), "Photos/2024/03-07", false, false,
+		},
+		{
+			"name template", []routeRule{{Glob: "*", Dest: "By/{ext}/{stem}/{dir}"}},
+			create("src/k.TXT", 1), "By/txt/k/src", false, false,
+		},
+		{"hostname", []routeRule{{Dest: "Hosts/{hostname}"}}, create("l.txt", 1), "Hosts/" + safeLocalName(host), false, false},
+		{"leaves the folder", []routeRule{{Dest: "../outside"}}, create("m.txt", 1), "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, skip, err := routeFile(tt.rules, tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("routeFile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if dir != tt.wantDir || skip != tt.wantSkip {
+				t.Errorf("routeFile() = %q, %v, want %q, %v", dir, skip, tt.wantDir, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestLoadRouteRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{"valid", `[{"glob": "*.jpg", "dest": "Photos/{year}"}]`, false},
+		{"invalid glob", `[{"glob": "[", "dest": "x"}]`, true},
+		{"invalid regex", `[{"regex": "(", "dest": "x"}]`, true},
+		{"unknown variable", `[{"dest": "Photos/{week}"}]`, true},
+		{"corrupt", `{`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "rules.json")
+			if err := os.WriteFile(file, []byte(tt.rules), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("GDRIVESYNC_RULES", file)
+			_, err := loadRouteRules()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadRouteRules() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClaimRemotePaths(t *testing.T) {
+	file := func(rel, dir string) File {
+		return File{Name: filepath.FromSlash(rel), RemoteDir: dir}
+	}
+	tests := []struct {
+		name   string
+		files  []File
+		synced map[string]string // local path to remote path of earlier syncs
+		want   []string
+	}{
+		{
+			"no collision",
+			[]File{file("a/x.jpg", "Photos"), file("b/y.jpg", "Photos")},
+			nil, []string{"a/x.jpg", "b/y.jpg"},
+		},
+		{
+			"same name routed to one folder",
+			[]File{file("a/x.jpg", "Photos"), file("b/x.jpg", "Photos")},
+			nil, []string{"a/x.jpg"},
+		},
+		{
+			"unrouted file keeps its path",
+			[]File{file("a/x.jpg", "Photos"), file("Photos/x.jpg", "")},
+			nil, []string{"Photos/x.jpg"},
+		},
+		{
+			"taken by an earlier sync",
+			[]File{file("b/x.jpg", "Photos")},
+			map[string]string{"a/x.jpg": "Photos/x.jpg"}, nil,
+		},
+		{
+			"own earlier route",
+			[]File{file("a/x.jpg", "Photos")},
+			map[string]string{"a/x.jpg": "Photos/x.jpg"}, []string{"a/x.jpg"},
+		},
+		{
+			"rerouted file frees its old path",
+			[]File{file("a/x.jpg", "Archive"), file("b/x.jpg", "Photos")},
+			map[string]string{"a/x.jpg": "Photos/x.jpg"}, []string{"a/x.jpg", "b/x.jpg"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &syncState{Files: map[string]stateEntry{}}
+			for rel, remote := range tt.synced {
+				state.set(rel, stateEntry{})
+				state.setRoute(rel, remote)
+			}
+			var got []string
+			for _, f := range claimRemotePaths(tt.files, state) {
+				got = append(got, filepath.ToSlash(f.Name))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("claimRemotePaths() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnrouteTree(t *testing.T) {
+	tests := []struct {
+		name   string
+		tree   map[string]string // path to ID, "folder" for folders
+		routes map[string]string
+		want   map[string]string
+	}{
+		{
+			"no routes",
+			map[string]string{"a.txt": "1"},
+			nil,
+			map[string]string{"a.txt": "1"},
+		},
+		{
+			"routed file and its folders",
+			map[string]string{"Photos": "folder", "Photos/2024": "folder", "Photos/2024/x.jpg": "1", "b.txt": "2"},
+			map[string]string{"camera/x.jpg": "Photos/2024/x.jpg"},
+			map[string]string{"camera/x.jpg": "1", "b.txt": "2"},
+		},
+		{
+			"folder with other content is kept",
+			map[string]string{"Photos": "folder", "Photos/x.jpg": "1", "Photos/own.jpg": "2"},
+			map[string]string{"camera/x.jpg": "Photos/x.jpg"},
+			map[string]string{"Photos": "folder", "camera/x.jpg": "1", "Photos/own.jpg": "2"},
+		},
+		{
+			"stale copy at the local path",
+			map[string]string{"x.jpg": "old", "Photos": "folder", "Photos/x.jpg": "1"},
+			map[string]string{"x.jpg": "Photos/x.jpg"},
+			map[string]string{"x.jpg": "1"},
+		},
+		{
+			"routed file deleted on Drive",
+			map[string]string{"x.jpg": "old"},
+			map[string]string{"x.jpg": "Photos/x.jpg"},
+			map[string]string{},
+		},
+		{
+			"chained routes",
+			map[string]string{"b.txt": "1", "c.txt": "2"},
+			map[string]string{"a.txt": "b.txt", "b.txt": "c.txt"},
+			map[string]string{"a.txt": "1", "b.txt": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := map[string]remoteObject{}
+			for rel, id := range tt.tree {
+				tree[rel] = remoteObject{ID: id, Folder: id == "folder"}
+			}
+			state := &syncState{Files: map[string]stateEntry{}}
+			for rel, remote := range tt.routes {
+				state.set(rel, stateEntry{})
+				state.setRoute(rel, remote)
+			}
+
+			unrouteTree(tree, state)
+
+			got := map[string]string{}
+			for rel, obj := range tree {
+				got[rel] = obj.ID
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tree = %v, want %v", sortedKeys(got), sortedKeys(tt.want))
+			}
+		})
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k, v := range m {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3UnsignedPayload is sent instead of a body hash so uploads can stream.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Backend is a prefix in an S3 compatible bucket, addressed path style
+// so MinIO and similar servers work without wildcard DNS. Requests are
+// signed with AWS Signature Version 4.
+type s3Backend struct {
+	client    *http.Client
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+}
+
+var _ backend = (*s3Backend)(nil)
+
+// newS3Backend opens a bucket using the environment:
+//
+//	GDRIVESYNC_S3_ENDPOINT  server URL (default https://s3.amazonaws.com)
+//	GDRIVESYNC_S3_REGION    signing region (default us-east-1)
+//	AWS_ACCESS_KEY_ID       access key
+//	AWS_SECRET_ACCESS_KEY   secret key
+func newS3Backend(bucket, prefix string) (*s3Backend, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 remote has no bucket")
+	}
+	endpoint, err := url.Parse(envString("GDRIVESYNC_S3_ENDPOINT", "https://s3.amazonaws.com"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GDRIVESYNC_S3_ENDPOINT: %v", err)
+	}
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	return &s3Backend{
+		client:    client,
+		endpoint:  endpoint,
+		region:    envString("GDRIVESYNC_S3_REGION", "us-east-1"),
+		bucket:    bucket,
+		prefix:    prefix,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}, nil
+}
+
+func (s *s3Backend) String() string { return "s3://" + s.bucket + "/" + s.prefix }
+
+// s3ListResult is the response of a ListObjectsV2 request.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Backend) list() (map[string]remoteObject, error) {
+	objects := map[string]remoteObject{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			rel := strings.TrimPrefix(obj.Key, s.prefix)
+			if rel == "" || strings.HasSuffix(rel, "/") {
+				continue
+			}
+			objects[rel] = remoteObject{ID: obj.Key, MD5: s3ETagMD5(obj.ETag), Size: obj.Size, ModTime: obj.LastModified}
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3ETagMD5 returns the MD5 held in an ETag. Objects uploaded in parts
+// have an ETag that is not the MD5 of their content.
+func s3ETagMD5(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != 32 || strings.Contains(etag, "-") {
+		return ""
+	}
+	return strings.ToLower(etag)
+}
+
+// mkdirs does nothing; buckets have no folders.
+func (s *s3Backend) mkdirs(dirs []string) error { return nil }
+
+// upload puts a local file at rel unless the object there already has its
+// MD5 as ETag.
+func (s *s3Backend) upload(localPath, rel string) (remoteObject, error) {
+	sum, err := hashes.md5(localPath)
+	if err != nil {
+		return remoteObject{}, err
+	}
+	raw, err := hex.DecodeString(sum)
+	if err != nil {
+		return remoteObject{}, err
+	}
+
+	existed := false
+	resp, err := s.do(http.MethodHead, s.prefix+rel, nil, nil, nil)
+	switch {
+	case err == nil:
+		resp.Body.Close()
+		existed = true
+		if s3ETagMD5(resp.Header.Get("ETag")) == sum {
+			fmt.Printf("%s is up to date.\n", rel)
+			modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+			return remoteObject{ID: s.prefix + rel, MD5: sum, Size: resp.ContentLength, ModTime: modTime}, nil
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return remoteObject{}, err
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return remoteObject{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return remoteObject{}, err
+	}
+
+	fmt.Printf("Uploading %s to %s...\n", rel, s)
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(raw))
+	resp, err = s.do(http.MethodPut, s.prefix+rel, nil, header, &s3Body{file, info.Size()})
+	if err != nil {
+		return remoteObject{}, err
+	}
+	resp.Body.Close()
+	undo := journalEntry{Action: actionCreate, Path: rel, Remote: s.String()}
+	if existed {
+		undo.Action = actionUpdate
+	}
+	journal.record(undo)
+	return remoteObject{ID: s.prefix + rel, MD5: sum, Size: info.Size(), ModTime: time.Now()}, nil
+}
+
+// setMetadata ignores metadata, which objects do not carry here.
+func (s *s3Backend) setMetadata(localPath string, obj remoteObject, meta fileMetadata) error {
+	return nil
+}
+
+func (s *s3Backend) flush() int { return 0 }
+
+func (s *s3Backend) download(obj remoteObject, localPath string) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodGet, obj.ID, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(localPath), ".gdrivesync-*")
+	if err != nil {
+		return err
+	}
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if want := s3ETagMD5(resp.Header.Get("ETag")); want != "" && want != hex.EncodeToString(hash.Sum(nil)) {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("%s: checksum mismatch", obj.ID)
+	}
+	return os.Rename(tmp.Name(), localPath)
+}
+
+func (s *s3Backend) openRevision(obj remoteObject, revisionID string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("%s keeps no revisions", s)
+}
+
+func (s *s3Backend) remove(rel string) error {
+	resp, err := s.do(http.MethodDelete, s.prefix+rel, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Body is a request body of known length.
+type s3Body struct {
+	io.Reader
+	size int64
+}
+
+// do sends a signed request for key in the bucket and turns error
+// responses into errors.
+func (s *s3Backend) do(method, key string, query url.Values, header http.Header, body *s3Body) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Body = io.NopCloser(body)
+		req.ContentLength = body.size
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.NewDecoder(resp.Body).Decode(&s3Err) == nil && s3Err.Code != "" {
+			if s3Err.Code == "NoSuchKey" {
+				return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+			}
+			return nil, fmt.Errorf("%s %s: %s: %s", method, key, s3Err.Code, s3Err.Message)
+		}
+		// HEAD responses have no body to tell a missing key by
+		if method == http.MethodHead && resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, key, resp.Status)
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 authorization header to req.
+// Requests are sent anonymously when no access key is configured.
+func (s *s3Backend) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	if s.accessKey == "" {
+		return
+	}
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Content-Md5") != "" {
+		signed = append(signed, "content-md5")
+	}
+	sort.Strings(signed)
+	var headers strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		strings.Join(signed, ";"),
+		s3UnsignedPayload,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format("20060102"), s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, strings.Join(signed, ";"), hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as
+// Signature Version 4 requires.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapePath escapes each segment of a slash separated path.
+func s3EscapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = s3Escape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
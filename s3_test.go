@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestS3Sign(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	const secret = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		region    string
+		accessKey string
+		header    map[string]string
+		want      string
+	}{
+		{
+			"list", http.MethodGet, "https://s3.amazonaws.com/bucket/?list-type=2&prefix=docs%2F", "us-east-1", "AKIDEXAMPLE", nil,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240102/us-east-1/s3/aws4_request, " +
+				"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+				"Signature=d3cd3725d317e5d0edbd57727b1c40fa5701e61264f7d7d4bba53cf7cbae9dab",
+		},
+		{
+			"upload with checksum", http.MethodPut, "http://localhost:9000/bucket/docs/a%20b.txt", "eu-west-1", "AKIDEXAMPLE",
+			map[string]string{"Content-Md5": "1B2M2Y8AsgTpgAmY7PhCfg=="},
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240102/eu-west-1/s3/aws4_request, " +
+				"SignedHeaders=content-md5;host;x-amz-content-sha256;x-amz-date, " +
+				"Signature=38e4364b96ba7f4a54e9add7829a9dca3811ab79d7a0143e214337c5bd219f6e",
+		},
+		{"anonymous", http.MethodGet, "https://s3.amazonaws.com/bucket/a.txt", "us-east-1", "", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			s := &s3Backend{region: tt.region, accessKey: tt.accessKey, secretKey: secret}
+			s.sign(req, now)
+
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("Authorization = %q, want %q", got, tt.want)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20240102T030405Z" {
+				t.Errorf("X-Amz-Date = %q", got)
+			}
+			if got := req.Header.Get("X-Amz-Content-Sha256"); got != s3UnsignedPayload {
+				t.Errorf("X-Amz-Content-Sha256 = %q", got)
+			}
+		})
+	}
+}
+
+func TestS3Escape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain-name_1.txt~", "plain-name_1.txt~"},
+		{"a b", "a%20b"},
+		{"a/b", "a%2Fb"},
+		{"a+b=c&d", "a%2Bb%3Dc%26d"},
+		{"é", "%C3%A9"},
+	}
+	for _, tt := range tests {
+		if got := s3Escape(tt.in); got != tt.want {
+			t.Errorf("s3Escape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestS3CanonicalQuery(t *testing.T) {
+	tests := []struct {
+		query url.Values
+		want  string
+	}{
+		{nil, ""},
+		{url.Values{"list-type": {"2"}}, "list-type=2"},
+		{url.Values{"prefix": {"docs/"}, "list-type": {"2"}}, "list-type=2&prefix=docs%2F"},
+		{url.Values{"continuation-token": {"a+b="}}, "continuation-token=a%2Bb%3D"},
+		{url.Values{"empty": {""}}, "empty="},
+	}
+	for _, tt := range tests {
+		if got := s3CanonicalQuery(tt.query); got != tt.want {
+			t.Errorf("s3CanonicalQuery(%v) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestS3EscapePath(t *testing.T) {
+	if got, want := s3EscapePath("/bucket/docs/a b+c.txt"), "/bucket/docs/a%20b%2Bc.txt"; got != want {
+		t.Errorf("s3EscapePath() = %q, want %q", got, want)
+	}
+}
+
+// fakeS3 is an in-memory stand-in for an S3 compatible server holding a
+// single bucket. Listings return two keys per page to exercise paging.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	puts    int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !ok {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r.URL.Query())
+		return
+	}
+	data, exists := f.objects[key]
+	etag := fmt.Sprintf(`"%x"`, md5.Sum(data))
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sum := md5.Sum(body)
+		if r.Header.Get("Content-Md5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			http.Error(w, "bad digest", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+		f.puts++
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum))
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>missing</Message></Error>")
+			}
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	end := min(start+2, len(keys))
+
+	var result s3ListResult
+	for _, key := range keys[start:end] {
+		data := f.objects[key]
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			ETag         string    `xml:"ETag"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{key, fmt.Sprintf(`"%x"`, md5.Sum(data)), int64(len(data)), time.Now().UTC()})
+	}
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: result})
+}
+
+func mustMkdir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newFakeS3 starts a fake server and points the S3 environment at it.
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{bucket: "bucket", objects: map[string][]byte{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	t.Setenv("GDRIVESYNC_S3_ENDPOINT", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	hashes = loadHashCache(filepath.Join(t.TempDir(), "hashcache.json"))
+	return f
+}
+
+func TestS3RoundTrip(t *testing.T) {
+	f := newFakeS3(t)
+	s, err := newS3Backend("bucket", "backup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := t.TempDir()
+	contents := map[string]string{"a.txt": "alpha", "docs/b c.txt": "bravo", "docs/d.txt": "delta"}
+	mustMkdir(t, filepath.Join(local, "docs"))
+	for rel, content := range contents {
+		mustWrite(t, filepath.Join(local, filepath.FromSlash(rel)), content)
+	}
+
+	tests := []struct {
+		name string
+		rel  string
+		puts int // total PUT requests after the upload
+	}{
+		{"new object", "a.txt", 1},
+		{"escaped key", "docs/b c.txt", 2},
+		{"third object", "docs/d.txt", 3},
+		{"unchanged object", "a.txt", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj, err := s.upload(filepath.Join(local, filepath.FromSlash(tt.rel)), tt.rel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("%x", md5.Sum([]byte(contents[tt.rel]))); obj.MD5 != want {
+				t.Errorf("MD5 = %s, want %s", obj.MD5, want)
+			}
+			if f.puts != tt.puts {
+				t.Errorf("%d PUT requests, want %d", f.puts, tt.puts)
+			}
+		})
+	}
+
+	objects, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != len(contents) {
+		t.Fatalf("listed %d objects, want %d", len(objects), len(contents))
+	}
+	dest := t.TempDir()
+	for rel, content := range contents {
+		obj, ok := objects[rel]
+		if !ok {
+			t.Fatalf("%s not listed", rel)
+		}
+		if obj.MD5 != fmt.Sprintf("%x", md5.Sum([]byte(content))) || obj.Size != int64(len(content)) {
+			t.Errorf("%s listed as %+v", rel, obj)
+		}
+		path := filepath.Join(dest, filepath.FromSlash(rel))
+		if err := s.download(obj, path); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(path); string(data) != content {
+			t.Errorf("downloaded %s = %q, want %q", rel, data, content)
+		}
+	}
+
+	if err := s.remove("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.objects["backup/a.txt"]; ok {
+		t.Error("a.txt still stored after remove")
+	}
+	err = s.download(objects["a.txt"], filepath.Join(dest, "a.txt"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("downloading a removed object: %v, want not exist", err)
+	}
+}
+
+// TestS3SyncAndPull syncs a folder to a bucket and pulls it into another
+// folder through the same code paths Drive pairs use.
+func TestS3SyncAndPull(t *testing.T) {
+	f := newFakeS3(t)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+	t.Setenv("GDRIVESYNC_RULES", filepath.Join(t.TempDir(), "rules.json"))
+
+	src := t.TempDir()
+	mustMkdir(t, filepath.Join(src, "docs"))
+	mustWrite(t, filepath.Join(src, "a.txt"), "alpha")
+	mustWrite(t, filepath.Join(src, "docs", "b.txt"), "bravo")
+	pair := syncPair{Name: "s3", Local: src, Remote: "s3://bucket/backup"}
+	b, err := openBackend(pair.Remote, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := loadSyncState(pair.stateFile())
+	if err := syncFolder(b, pair, state); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(f.objects); got != 2 {
+		t.Fatalf("%d objects stored, want 2", got)
+	}
+	if _, err := os.Stat(pair.checkpointFile()); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left behind: %v", err)
+	}
+
+	dest := t.TempDir()
+	mustWrite(t, filepath.Join(dest, "stale.txt"), "synced before")
+	pulled := &syncState{Files: map[string]stateEntry{"stale.txt": {MD5: "x"}}}
+	if err := pullFolder(b, dest, pulled); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range map[string]string{"a.txt": "alpha", "docs/b.txt": "bravo"} {
+		data, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(rel)))
+		if err != nil || string(data) != want {
+			t.Errorf("pulled %s = %q, %v; want %q", rel, data, err, want)
+		}
+		if entry, _ := pulled.get(rel); entry.MD5 != fmt.Sprintf("%x", md5.Sum([]byte(want))) {
+			t.Errorf("%s recorded as %+v", rel, entry)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "stale.txt")); !os.IsNotExist(err) {
+		t.Errorf("stale.txt deleted remotely but kept locally: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// scanErrorExitCode is the exit status of a run that completed but had to
+// skip local entries it could not read.
+const scanErrorExitCode = 2
+
+// scanError is a local path the scanner had to skip.
+type scanError struct {
+	Path string
+	Err  error
+}
+
+// scanErrorList collects the paths skipped while scanning local folders.
+type scanErrorList struct {
+	mu   sync.Mutex
+	errs []scanError
+}
+
+// scanErrors collects the scan errors of the current run.
+var scanErrors scanErrorList
+
+// add records that path was skipped because of err.
+func (l *scanErrorList) add(path string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs = append(l.errs, scanError{Path: path, Err: err})
+}
+
+// count returns the number of skipped paths.
+func (l *scanErrorList) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.errs)
+}
+
+// reset forgets the errors of an earlier scan, so a long running watch
+// only reports what its latest scan skipped.
+func (l *scanErrorList) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs = nil
+}
+
+// report prints the skipped paths, sorted by path.
+func (l *scanErrorList) report() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.errs) == 0 {
+		return
+	}
+	sort.Slice(l.errs, func(i, j int) bool { return l.errs[i].Path < l.errs[j].Path })
+	fmt.Printf("%d local entries could not be scanned and were skipped:\n", len(l.errs))
+	for _, e := range l.errs {
+		fmt.Printf("  %s: %v\n", e.Path, e.Err)
+	}
+}
+
+// exitOnScanErrors reports scan errors and exits with scanErrorExitCode if
+// there were any.
+func exitOnScanErrors() {
+	if scanErrors.count() == 0 {
+		return
+	}
+	scanErrors.report()
+	os.Exit(scanErrorExitCode)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Secret scan modes, set with GDRIVESYNC_SECRET_SCAN.
+const (
+	// secretScanOff uploads files without looking at them.
+	secretScanOff = "off"
+	// secretScanBlock leaves matching files in place but never uploads them.
+	secretScanBlock = "block"
+	// secretScanQuarantine moves matching files into localQuarantineDir.
+	secretScanQuarantine = "quarantine"
+)
+
+// localQuarantineDir holds files the secret scanner refused to upload,
+// inside the local sync folder.
+const localQuarantineDir = ".gdrivesync-quarantine"
+
+// secretRule is a regular expression that marks content as sensitive.
+type secretRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	re      *regexp.Regexp
+}
+
+// builtinSecretRules detect private keys and common cloud credentials.
+var builtinSecretRules = []secretRule{
+	{Name: "private key", Pattern: `-----BEGIN [A-Z0-9 ]*PRIVATE KEY( BLOCK)?-----`},
+	{Name: "AWS access key", Pattern: `\b(AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{Name: "AWS secret key", Pattern: `(?i)aws_secret_access_key\s*[=:]\s*["']?[A-Za-z0-9/+=]{40}`},
+	{Name: "Google API key", Pattern: `\bAIza[0-9A-Za-z_\-]{35}\b`},
+	{Name: "Google service account", Pattern: `"type"\s*:\s*"service_account"`},
+	{Name: "GitHub token", Pattern: `\b(gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`},
+	{Name: "Slack token", Pattern: `\bxox[abprs]-[A-Za-z0-9-]{10,}`},
+}
+
+// secretFileNames are base names, as path.Match patterns, of files that
+// hold secrets whatever their content.
+var secretFileNames = []string{
+	".env", ".env.*", "*.pem", "*.key", "*.p12", "*.pfx", "*.jks",
+	"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519", ".netrc", ".pgpass",
+}
+
+// secretTokenPattern finds candidates for the high-entropy detector: long
+// tokens assigned to something named like a key, token, secret or password.
+var secretTokenPattern = regexp.MustCompile(`(?i)(?:key|token|secret|passw(?:or)?d|credential|auth)[A-Za-z0-9_.\-]*["']?\s*[:=]\s*["']?([A-Za-z0-9+/=_\-]{32,})`)
+
+// hashTokenPattern matches subresource integrity hashes, which look random
+// but are published checksums.
+var hashTokenPattern = regexp.MustCompile(`^(?:md5|sha1|sha256|sha384|sha512)-[A-Za-z0-9+/=]+$`)
+
+// hexTokenPattern matches tokens written in a single case of hex digits.
+var hexTokenPattern = regexp.MustCompile(`^(?:[0-9a-f]+|[0-9A-F]+)$`)
+
+// letterPattern finds a letter in a token.
+var letterPattern = regexp.MustCompile(`[A-Za-z]`)
+
+// entropyExemptNames are base names, as path.Match patterns, of lockfiles
+// and checksum lists the high-entropy detector skips.
+var entropyExemptNames = []string{
+	"go.sum", "package-lock.json", "npm-shrinkwrap.json", "yarn.lock", "pnpm-lock.yaml",
+	"Cargo.lock", "Gemfile.lock", "composer.lock", "poetry.lock", "Pipfile.lock",
+	"*SUMS", "*.sha256", "*.sha512",
+}
+
+// secretFinding is a file the scanner kept from being uploaded.
+type secretFinding struct {
+	Path string
+	Rule string
+}
+
+// secretScanner checks files for secrets before they are uploaded.
+type secretScanner struct {
+	mode    string
+	rules   []secretRule
+	maxSize int64
+	// entropy and hexEntropy are the thresholds, in bits per character,
+	// for base64 or alphanumeric tokens and for hex tokens. Hex uses only
+	// 16 symbols, so it can never reach the entropy of the wider sets.
+	entropy    float64
+	hexEntropy float64
+
+	mu       sync.Mutex
+	findings []secretFinding
+}
+
+// secrets is the secret scanner of this run. Checking with a nil scanner
+// allows every file.
+var secrets *secretScanner
+
+// newSecretScanner configures the scanner from the environment:
+//
+//	GDRIVESYNC_SECRET_SCAN           off (default), block or quarantine
+//	GDRIVESYNC_SECRET_RULES          JSON file of extra rules, [{"name": ..., "pattern": ...}]
+//	GDRIVESYNC_SECRET_SCAN_MAX_SIZE  bytes of each file that are scanned (default 1 MiB)
+//	GDRIVESYNC_SECRET_ENTROPY        bits per character above which a base64 or alphanumeric token counts as a secret (default 4.2)
+//	GDRIVESYNC_SECRET_HEX_ENTROPY    the same for hex tokens (default 3.0)
+//
+// It returns nil when scanning is off.
+func newSecretScanner() (*secretScanner, error) {
+	mode := envString("GDRIVESYNC_SECRET_SCAN", secretScanOff)
+	switch mode {
+	case secretScanOff:
+		return nil, nil
+	case secretScanBlock, secretScanQuarantine:
+	default:
+		return nil, fmt.Errorf("invalid value for GDRIVESYNC_SECRET_SCAN: %q", mode)
+	}
+
+	rules := append([]secretRule(nil), builtinSecretRules...)
+	if file := os.Getenv("GDRIVESYNC_SECRET_RULES"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var custom []secretRule
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return nil, fmt.Errorf("corrupt secret rules %s: %v", file, err)
+		}
+		rules = append(rules, custom...)
+	}
+	for i := range rules {
+		re, err := regexp.Compile(rules[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("secret rule %q: %v", rules[i].Name, err)
+		}
+		rules[i].re = re
+	}
+
+	return &secretScanner{
+		mode:       mode,
+		rules:      rules,
+		maxSize:    int64(envInt("GDRIVESYNC_SECRET_SCAN_MAX_SIZE", 1<<20)),
+		entropy:    envFloat("GDRIVESYNC_SECRET_ENTROPY", 4.2),
+		hexEntropy: envFloat("GDRIVESYNC_SECRET_HEX_ENTROPY", 3.0),
+	}, nil
+}
+
+// scan returns the name of the first detector matching the file at
+// localPath, or "" if it looks clean.
+func (s *secretScanner) scan(localPath string) (string, error) {
+	base := filepath.Base(localPath)
+	for _, pattern := range secretFileNames {
+		if ok, _ := path.Match(pattern, base); ok {
+			return "file name " + pattern, nil
+		}
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, s.maxSize))
+	if err != nil {
+		return "", err
+	}
+
+	for _, rule := range s.rules {
+		if rule.re.Match(data) {
+			return rule.Name, nil
+		}
+	}
+
+	// Random looking tokens only matter in text; binary data is full of them
+	if entropyExempt(base) || bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return "", nil
+	}
+	for _, match := range secretTokenPattern.FindAllSubmatch(data, -1) {
+		if s.randomToken(match[1]) {
+			return "high-entropy token", nil
+		}
+	}
+	return "", nil
+}
+
+// randomToken reports whether a token looks randomly generated, judged
+// against the entropy threshold of its character set. Generated tokens
+// mix letters and digits; without digits they are words joined into an
+// identifier, without letters they are numbers.
+func (s *secretScanner) randomToken(token []byte) bool {
+	if hashTokenPattern.Match(token) || !bytes.ContainsAny(token, "0123456789") || !letterPattern.Match(token) {
+		return false
+	}
+	threshold := s.entropy
+	if hexTokenPattern.Match(token) {
+		threshold = s.hexEntropy
+	}
+	return shannonEntropy(token) >= threshold
+}
+
+// entropyExempt reports whether a file, by its base name, is a lockfile or
+// checksum list full of hashes.
+func entropyExempt(base string) bool {
+	for _, pattern := range entropyExemptNames {
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// shannonEntropy returns the entropy of data in bits per byte.
+func shannonEntropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	entropy := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(data))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// allow reports whether a local file may be uploaded. Every file is
+// scanned, including ones synced before scanning was turned on, so secrets
+// already on the remote are reported too. A file with a finding is
+// recorded for the report and, in quarantine mode, moved out of root.
+func (s *secretScanner) allow(root string, file File) bool {
+	if s == nil {
+		return true
+	}
+	rel := filepath.ToSlash(file.Name)
+
+	rule, err := s.scan(file.Path)
+	if err != nil {
+		log.Printf("Unable to scan %s for secrets: %v\n", rel, err)
+		rule = "unreadable"
+	}
+	if rule == "" {
+		return true
+	}
+
+	if s.mode == secretScanQuarantine {
+		dest := filepath.Join(root, localQuarantineDir, file.Name)
+		err := os.MkdirAll(filepath.Dir(dest), 0700)
+		if err == nil {
+			err = os.Rename(file.Path, dest)
+		}
+		if err != nil {
+			log.Printf("Unable to quarantine %s: %v\n", rel, err)
+		}
+	}
+
+	s.mu.Lock()
+	s.findings = append(s.findings, secretFinding{Path: rel, Rule: rule})
+	s.mu.Unlock()
+	return false
+}
+
+// report prints the files that were kept from being uploaded.
+func (s *secretScanner) report() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.findings) == 0 {
+		return
+	}
+	sort.Slice(s.findings, func(i, j int) bool { return s.findings[i].Path < s.findings[j].Path })
+	action := "blocked"
+	if s.mode == secretScanQuarantine {
+		action = "quarantined in " + localQuarantineDir
+	}
+	fmt.Printf("%d files may contain secrets and were %s:\n", len(s.findings), action)
+	for _, f := range s.findings {
+		fmt.Printf("  %s (%s)\n", f.Path, f.Rule)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const shortcutMimeType = "application/vnd.google-apps.shortcut"
+
+// Shortcut policies selected with GDRIVESYNC_SHORTCUTS.
+const (
+	// shortcutSkip ignores shortcuts entirely (the default).
+	shortcutSkip = "skip"
+	// shortcutResolve treats a shortcut as a copy of its target, descending
+	// into target folders.
+	shortcutResolve = "resolve"
+	// shortcutLink represents a shortcut as a symlink when its target is in
+	// the synced tree and as a .url file otherwise.
+	shortcutLink = "link"
+)
+
+// shortcutPolicy returns the configured shortcut policy.
+func shortcutPolicy() string {
+	policy := envString("GDRIVESYNC_SHORTCUTS", shortcutSkip)
+	switch policy {
+	case shortcutSkip, shortcutResolve, shortcutLink:
+		return policy
+	}
+	log.Fatalf("Invalid value for GDRIVESYNC_SHORTCUTS: %q", policy)
+	return ""
+}
+
+// resolveShortcut fetches the target of a shortcut, named like the shortcut.
+// The target keeps the shortcut's details, which marks it as reached
+// through a shortcut (see viaShortcut).
+func resolveShortcut(service *drive.Service, shortcut *drive.File) (*drive.File, error) {
+	if shortcut.ShortcutDetails == nil {
+		return nil, fmt.Errorf("shortcut %s has no target", shortcut.Name)
+	}
+	target, err := service.Files.Get(shortcut.ShortcutDetails.TargetId).Fields(driveFileFields + ", trashed").Do()
+	if err != nil {
+		return nil, err
+	}
+	if target.Trashed {
+		return nil, fmt.Errorf("target of shortcut %s is trashed", shortcut.Name)
+	}
+	target.Name = shortcut.Name
+	target.ShortcutDetails = shortcut.ShortcutDetails
+	return target, nil
+}
+
+// viaShortcut returns the paths of a tree that were reached by resolving a
+// shortcut: resolved targets and everything below resolved folders. They
+// stand for files that live elsewhere on Drive, so a sync must not upload
+// them back.
+func viaShortcut(tree map[string]*drive.File) map[string]bool {
+	resolved := map[string]bool{}
+	for rel, f := range tree {
+		if f.MimeType != shortcutMimeType && f.ShortcutDetails != nil {
+			resolved[rel] = true
+		}
+	}
+	derived := map[string]bool{}
+	if len(resolved) == 0 {
+		return derived
+	}
+	for rel := range tree {
+		for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+			if resolved[p] {
+				derived[rel] = true
+				break
+			}
+		}
+	}
+	return derived
+}
+
+// markShortcutTargets flags the state entries of paths reached through a
+// shortcut so withoutShortcuts keeps them from being uploaded.
+func markShortcutTargets(tree map[string]remoteObject, state *syncState) {
+	for rel, obj := range tree {
+		if !obj.ViaShortcut {
+			continue
+		}
+		if entry, ok := state.get(rel); ok && !entry.Shortcut {
+			entry.Shortcut = true
+			state.set(rel, entry)
+		}
+	}
+}
+
+// placeShortcutLinks decides how each shortcut kept by the link policy is
+// represented locally: shortcuts to items inside the tree stay under their
+// own path and become symlinks, all others move to a ".url" path.
+func placeShortcutLinks(tree map[string]*drive.File) {
+	inTree := map[string]bool{}
+	for _, f := range tree {
+		if f.MimeType != shortcutMimeType {
+			inTree[f.Id] = true
+		}
+	}
+	var outside []string
+	for rel, f := range tree {
+		if f.MimeType == shortcutMimeType && f.ShortcutDetails != nil && !inTree[f.ShortcutDetails.TargetId] {
+			outside = append(outside, rel)
+		}
+	}
+	for _, rel := range outside {
+		tree[rel+".url"] = tree[rel]
+		delete(tree, rel)
+	}
+}
+
+// pullShortcut creates the local representation of a shortcut: a relative
+// symlink to its target's path, or a .url file opening the target in Drive.
+func pullShortcut(root, rel string, shortcut remoteObject, paths map[string]string, state *syncState) error {
+	localPath := filepath.Join(root, filepath.FromSlash(rel))
+	targetID := shortcut.Shortcut
+
+	if targetRel, ok := paths[targetID]; ok {
+		link, err := filepath.Rel(filepath.Dir(localPath), filepath.Join(root, filepath.FromSlash(targetRel)))
+		if err != nil {
+			return err
+		}
+		if current, err := os.Readlink(localPath); err == nil && current == link {
+			return nil
+		}
+		if err := replaceLocal(root, rel, state); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		fmt.Printf("Linking %s to %s...\n", rel, targetRel)
+		if err := os.Symlink(link, localPath); err != nil {
+			return err
+		}
+	} else {
+		content := fmt.Sprintf("[InternetShortcut]\r\nURL=https://drive.google.com/open?id=%s\r\n", targetID)
+		if current, err := os.ReadFile(localPath); err == nil && string(current) == content {
+			return nil
+		}
+		if err := replaceLocal(root, rel, state); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		fmt.Printf("Writing shortcut %s...\n", rel)
+		if err := os.WriteFile(localPath, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	state.set(rel, stateEntry{DriveID: shortcut.ID, Shortcut: true})
+	return nil
+}
+
+// replaceLocal moves whatever is at rel to the local trash, unless it is
+// a shortcut created by an earlier pull.
+func replaceLocal(root, rel string, state *syncState) error {
+	if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(rel))); os.IsNotExist(err) {
+		return nil
+	}
+	if entry, ok := state.get(rel); ok && entry.Shortcut {
+		return os.Remove(filepath.Join(root, filepath.FromSlash(rel)))
+	}
+	return moveToLocalTrash(root, state.trashStamp(), filepath.FromSlash(rel))
+}
+
+// withoutShortcuts drops local files that stand for Drive shortcuts so a
+// push does not upload them as regular files.
+func withoutShortcuts(files []File, state *syncState) []File {
+	kept := files[:0]
+	for _, file := range files {
+		if entry, ok := state.get(path.Clean(filepath.ToSlash(file.Name))); ok && entry.Shortcut {
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const syncStateFile = "state.json"
+
+// stateEntry describes a file as it was when it was last synced.
+type stateEntry struct {
+	DriveID    string    `json:"driveId"`
+	MD5        string    `json:"md5"`
+	Size       int64     `json:"size"`
+	RevisionID string    `json:"revisionId,omitempty"`
+	Shortcut   bool      `json:"shortcut,omitempty"`
+	LinkOf     string    `json:"linkOf,omitempty"`
+	SyncedAt   time.Time `json:"syncedAt"`
+}
+
+// syncState remembers which files were synced so deletions on one side can
+// be told apart from new files on the other.
+type syncState struct {
+	mu    sync.Mutex
+	file  string
+	Files map[string]stateEntry `json:"files"`
+	// Routes holds the remote path of files that routing rules uploaded
+	// somewhere other than their local path, keyed by local path.
+	Routes map[string]string `json:"routes,omitempty"`
+	// Watermark is when the last sync that completed without errors started.
+	Watermark time.Time `json:"watermark"`
+	// LastFull is when the last such sync that considered every file started.
+	LastFull time.Time `json:"lastFull"`
+	// HasLinks is set once a manifest of hard links exists on the remote.
+	HasLinks bool `json:"hasLinks,omitempty"`
+
+	runStart time.Time
+	stamp    string // local trash directory of this run
+	since    time.Time
+	full     bool
+}
+
+// loadSyncState reads the sync state from a local file. A missing state is
+// treated as empty.
+func loadSyncState(file string) *syncState {
+	st := &syncState{file: file, Files: map[string]stateEntry{}}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Unable to read sync state: %v\n", err)
+		}
+		return st
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		log.Fatalf("Corrupt sync state %s: %v", file, err)
+	}
+	if st.Files == nil {
+		st.Files = map[string]stateEntry{}
+	}
+	return st
+}
+
+// get returns the entry for a relative path.
+func (st *syncState) get(name string) (stateEntry, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	entry, ok := st.Files[name]
+	return entry, ok
+}
+
+// set records that a relative path was synced.
+func (st *syncState) set(name string, entry stateEntry) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	entry.SyncedAt = time.Now()
+	st.Files[name] = entry
+}
+
+// remove forgets a relative path.
+func (st *syncState) remove(name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.Files, name)
+	delete(st.Routes, name)
+}
+
+// setRoute records the remote path a file was uploaded to.
+func (st *syncState) setRoute(name, remote string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if remote == name {
+		delete(st.Routes, name)
+		return
+	}
+	if st.Routes == nil {
+		st.Routes = map[string]string{}
+	}
+	st.Routes[name] = remote
+}
+
+// remotePaths returns the remote path of every synced file keyed by its
+// local path.
+func (st *syncState) remotePaths() map[string]string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	paths := make(map[string]string, len(st.Files))
+	for name := range st.Files {
+		paths[name] = name
+	}
+	for name, remote := range st.Routes {
+		paths[name] = remote
+	}
+	return paths
+}
+
+// save writes the state to disk.
+func (st *syncState) save() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := st.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.file)
+}
+
+// trashStamp returns the name of the local trash directory of this run,
+// so everything a run moves to the local trash ends up together.
+func (st *syncState) trashStamp() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.stamp == "" {
+		st.stamp = time.Now().UTC().Format(localTrashStamp)
+	}
+	return st.stamp
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// newHTTPClient builds the HTTP client shared by the OAuth exchange and the
+// Drive API. It is configured through environment variables:
+//
+//	GDRIVESYNC_PROXY            proxy URL, overrides HTTPS_PROXY/HTTP_PROXY
+//	GDRIVESYNC_PROXY_USER       proxy user name, if not part of the URL
+//	GDRIVESYNC_PROXY_PASSWORD   proxy password
+//	GDRIVESYNC_CA_BUNDLE        extra PEM bundles, separated by the OS path list separator
+//	GDRIVESYNC_DIAL_TIMEOUT     TCP connect timeout (default 30s)
+//	GDRIVESYNC_TLS_TIMEOUT      TLS handshake timeout (default 10s)
+//	GDRIVESYNC_RESPONSE_TIMEOUT time to wait for response headers (default none)
+//	GDRIVESYNC_IDLE_TIMEOUT     how long idle connections are kept (default 90s)
+//	GDRIVESYNC_KEEPALIVE        reuse connections between requests (default true)
+//	GDRIVESYNC_TCP_KEEPALIVE    TCP keep-alive probe interval (default 30s)
+//	GDRIVESYNC_HTTP2            negotiate HTTP/2 (default true)
+func newHTTPClient() (*http.Client, error) {
+	proxy, err := proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	rootCAs, err := rootCAPool()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   envDuration("GDRIVESYNC_DIAL_TIMEOUT", 30*time.Second),
+		KeepAlive: envDuration("GDRIVESYNC_TCP_KEEPALIVE", 30*time.Second),
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       &tls.Config{RootCAs: rootCAs},
+		TLSHandshakeTimeout:   envDuration("GDRIVESYNC_TLS_TIMEOUT", 10*time.Second),
+		ResponseHeaderTimeout: envDuration("GDRIVESYNC_RESPONSE_TIMEOUT", 0),
+		IdleConnTimeout:       envDuration("GDRIVESYNC_IDLE_TIMEOUT", 90*time.Second),
+		DisableKeepAlives:     !envBool("GDRIVESYNC_KEEPALIVE", true),
+		MaxIdleConns:          100,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	if !envBool("GDRIVESYNC_HTTP2", true) {
+		// A non-nil empty map disables HTTP/2 negotiation
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// proxyFunc returns the proxy selection function for the transport. An
+// explicit GDRIVESYNC_PROXY wins over the standard proxy variables, and
+// credentials from GDRIVESYNC_PROXY_USER/PASSWORD are added when the proxy
+// URL carries none.
+func proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	user := os.Getenv("GDRIVESYNC_PROXY_USER")
+	password := os.Getenv("GDRIVESYNC_PROXY_PASSWORD")
+	withCredentials := func(u *url.URL) *url.URL {
+		if u == nil || u.User != nil || user == "" {
+			return u
+		}
+		u = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+		u.User = url.UserPassword(user, password)
+		return u
+	}
+
+	if raw := os.Getenv("GDRIVESYNC_PROXY"); raw != "" {
+		proxyURL, err := url.Parse(raw)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid GDRIVESYNC_PROXY %q", raw)
+		}
+		return http.ProxyURL(withCredentials(proxyURL)), nil
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := http.ProxyFromEnvironment(req)
+		if err != nil {
+			return nil, err
+		}
+		return withCredentials(proxyURL), nil
+	}, nil
+}
+
+// rootCAPool returns the system roots extended with the bundles listed in
+// GDRIVESYNC_CA_BUNDLE, or nil to use the system roots unchanged.
+func rootCAPool() (*x509.CertPool, error) {
+	bundles := filepath.SplitList(os.Getenv("GDRIVESYNC_CA_BUNDLE"))
+	if len(bundles) == 0 {
+		return nil, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, bundle := range bundles {
+		pem, err := os.ReadFile(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", bundle)
+		}
+	}
+	return pool, nil
+}
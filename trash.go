@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// trashedItem is an explicitly trashed Drive item below the sync root.
+type trashedItem struct {
+	File *drive.File
+	Path string // slash separated path relative to the sync root
+}
+
+// listTrashed returns the explicitly trashed items whose parent is a live
+// folder below rootID. Items inside a trashed folder are represented by
+// the folder itself.
+func listTrashed(service *drive.Service, rootID string) ([]trashedItem, error) {
+	folders, err := listDriveFolders(service, rootID)
+	if err != nil {
+		return nil, err
+	}
+	dirOf := make(map[string]string, len(folders))
+	var ids []string
+	for dir, id := range folders {
+		dirOf[id] = dir
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Query the parents in chunks to keep the query string short
+	var items []trashedItem
+	for start := 0; start < len(ids); start += 50 {
+		end := start + 50
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var parents []string
+		for _, id := range ids[start:end] {
+			parents = append(parents, fmt.Sprintf("'%s' in parents", id))
+		}
+		query := "trashed=true and (" + strings.Join(parents, " or ") + ")"
+
+		pageToken := ""
+		for {
+			list, err := service.Files.List().Q(query).
+				Fields("nextPageToken, files(id, name, mimeType, size, parents, trashedTime, explicitlyTrashed)").
+				PageToken(pageToken).PageSize(1000).Do()
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range list.Files {
+				if !f.ExplicitlyTrashed || len(f.Parents) == 0 {
+					continue
+				}
+				items = append(items, trashedItem{File: f, Path: path.Join(dirOf[f.Parents[0]], f.Name)})
+			}
+			if list.NextPageToken == "" {
+				break
+			}
+			pageToken = list.NextPageToken
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+	return items, nil
+}
+
+// runTrash implements the trash subcommands. They work on the Drive folder
+// of the pair selected with -pair.
+func runTrash(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: gdrivesync trash list|restore|empty [-pair name] [flags]")
+	}
+
+	flags := flag.NewFlagSet("trash "+args[0], flag.ExitOnError)
+	pairName := pairFlag(flags)
+	switch args[0] {
+	case "list":
+		flags.Parse(args[1:])
+		pair, rootID := trashPair(*pairName)
+		service := newDriveService()
+		items, err := listTrashed(service, rootID)
+		if err != nil {
+			log.Fatalf("Unable to list trash of %s: %v", pair.Name, err)
+		}
+		for _, item := range items {
+			fmt.Printf("%s  %s  %10d  %s\n", item.File.Id, item.File.TrashedTime, item.File.Size, item.Path)
+		}
+		fmt.Printf("%d trashed items.\n", len(items))
+
+	case "restore":
+		pull := flags.Bool("pull", false, "also download restored items into the local folder")
+		dryRun := flags.Bool("dry-run", false, "only show what would be restored")
+		flags.Parse(args[1:])
+		if flags.NArg() == 0 {
+			log.Fatal("Usage: gdrivesync trash restore [-pair name] [-pull] [-dry-run] <id|path>...")
+		}
+
+		pair, rootID := trashPair(*pairName)
+		service := newDriveService()
+		items, err := listTrashed(service, rootID)
+		if err != nil {
+			log.Fatalf("Unable to list trash of %s: %v", pair.Name, err)
+		}
+		selected := selectTrashed(items, flags.Args())
+		if err := restoreTrashed(service, pair.Local, selected, *pull, *dryRun); err != nil {
+			log.Fatalf("Error restoring from trash: %v", err)
+		}
+
+	case "empty":
+		olderThan := flags.Duration("older-than", 0, "only delete items trashed longer ago than this")
+		dryRun := flags.Bool("dry-run", false, "only show what would be deleted")
+		yes := flags.Bool("yes", false, "do not ask for confirmation")
+		flags.Parse(args[1:])
+
+		pair, rootID := trashPair(*pairName)
+		service := newDriveService()
+		items, err := listTrashed(service, rootID)
+		if err != nil {
+			log.Fatalf("Unable to list trash of %s: %v", pair.Name, err)
+		}
+		if err := emptyTrash(service, items, *olderThan, *dryRun, *yes); err != nil {
+			log.Fatalf("Error emptying trash: %v", err)
+		}
+
+	default:
+		log.Fatalf("Unknown trash command %q", args[0])
+	}
+}
+
+// trashPair selects the pair whose Drive trash a command works on.
+func trashPair(key string) (syncPair, string) {
+	pair := findSyncPair(key)
+	rootID, err := pair.driveRoot()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pair, rootID
+}
+
+// selectTrashed picks the items matching the given IDs or relative paths.
+func selectTrashed(items []trashedItem, keys []string) []trashedItem {
+	var selected []trashedItem
+	for _, key := range keys {
+		found := false
+		for _, item := range items {
+			if item.File.Id == key || item.Path == filepath.ToSlash(key) {
+				selected = append(selected, item)
+				found = true
+			}
+		}
+		if !found {
+			log.Printf("No trashed item matches %s\n", key)
+		}
+	}
+	return selected
+}
+
+// restoreTrashed untrashes items and optionally downloads them into the
+// local folder root.
+func restoreTrashed(service *drive.Service, root string, items []trashedItem, pull, dryRun bool) error {
+	if dryRun {
+		for _, item := range items {
+			fmt.Printf("Would restore %s\n", item.Path)
+		}
+		return nil
+	}
+
+	requests := make([]*batchRequest, len(items))
+	for i, item := range items {
+		fmt.Printf("Restoring %s...\n", item.Path)
+		requests[i] = newTrashRequest(item.File.Id, false)
+	}
+	batchErr := runBatch(service, requests)
+
+	for i, item := range items {
+		audit.record("untrash", item.Path, item.File.Id, "", requests[i].Err)
+		if requests[i].Err != nil {
+			log.Printf("Error restoring %s: %v\n", item.Path, requests[i].Err)
+			continue
+		}
+		if pull {
+			localPath := filepath.Join(root, filepath.FromSlash(path.Dir(item.Path)), safeLocalName(item.File.Name))
+			if err := downloadDriveTree(service, item.File, localPath); err != nil {
+				return err
+			}
+		}
+	}
+	return batchErr
+}
+
+// emptyTrash permanently deletes trashed items older than olderThan after
+// asking for confirmation.
+func emptyTrash(service *drive.Service, items []trashedItem, olderThan time.Duration, dryRun, yes bool) error {
+	cutoff := time.Now().Add(-olderThan)
+	var expired []trashedItem
+	for _, item := range items {
+		trashedAt, err := time.Parse(time.RFC3339, item.File.TrashedTime)
+		if olderThan == 0 || (err == nil && trashedAt.Before(cutoff)) {
+			expired = append(expired, item)
+		}
+	}
+	if len(expired) == 0 {
+		fmt.Println("Nothing to delete.")
+		return nil
+	}
+
+	for _, item := range expired {
+		fmt.Printf("%s  %s\n", item.File.TrashedTime, item.Path)
+	}
+	if dryRun {
+		fmt.Printf("Would permanently delete %d items.\n", len(expired))
+		return nil
+	}
+	if !yes && !confirm(fmt.Sprintf("Permanently delete %d items?", len(expired))) {
+		fmt.Println("Aborted.")
+		return nil
+	}
+
+	requests := make([]*batchRequest, len(expired))
+	for i, item := range expired {
+		requests[i] = newDeleteRequest(item.File.Id)
+	}
+	err := runBatch(service, requests)
+	for i, item := range expired {
+		audit.record("delete", item.Path, item.File.Id, "", requests[i].Err)
+		if requests[i].Err != nil {
+			log.Printf("Error deleting %s: %v\n", item.Path, requests[i].Err)
+		}
+	}
+	return err
+}
+
+// confirm asks a yes/no question on the terminal.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// isOffline reports whether err means Drive could not be reached at all,
+// as opposed to Drive or the token endpoint rejecting the request. Every
+// error of the HTTP client is a net.Error, so only failed connections,
+// failed name lookups and timeouts count.
+func isOffline(err error) bool {
+	var apiErr *googleapi.Error
+	var tokenErr *oauth2.RetrieveError
+	if errors.As(err, &apiErr) || errors.As(err, &tokenErr) {
+		return false
+	}
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	if errors.As(err, &opErr) || errors.As(err, &dnsErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// fileStamp is what the watcher compares to notice a changed file.
+type fileStamp struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// watcher polls the local folder of a sync pair and uploads changed files.
+// While Drive is unreachable changes pile up in an on-disk queue;
+// reachability is probed with exponentially growing intervals and the
+// queue is replayed in order once Drive answers again. Changes that fail
+// for other reasons stay queued and are retried with backoff.
+type watcher struct {
+	remote   *driveBackend
+	root     string
+	state    *syncState
+	queue    *changeQueue
+	rules    []routeRule
+	stamps   map[string]fileStamp
+	offline  bool
+	limited  string // why the queue exceeds the run limits, reported once
+	probeIn  time.Duration
+	probeAt  time.Time
+	maxProbe time.Duration
+}
+
+// scan queues every file whose size or modification time changed since
+// the last scan. On the first scan files whose content differs from the
+// last sync are queued.
+func (w *watcher) scan() {
+	files, err := listLocalFiles(w.root)
+	if err != nil {
+		log.Printf("Error scanning %s: %v\n", w.root, err)
+		scanErrors.add(w.root, err)
+		return
+	}
+	files = withoutShortcuts(files, w.state)
+	files = withoutHardLinks(files, w.state)
+
+	first := w.stamps == nil
+	stamps := make(map[string]fileStamp, len(files))
+	for _, file := range files {
+		rel := filepath.ToSlash(file.Name)
+		stamp := fileStamp{Size: file.Size, ModTime: file.ModTime}
+		stamps[rel] = stamp
+
+		if first {
+			sum, err := hashes.md5(file.Path)
+			if entry, ok := w.state.get(rel); err == nil && ok && entry.MD5 == sum {
+				continue
+			}
+		} else if old, ok := w.stamps[rel]; ok && old.Size == stamp.Size && old.ModTime.Equal(stamp.ModTime) {
+			continue
+		}
+		w.queue.push(rel)
+	}
+	w.stamps = stamps
+	if err := w.queue.save(); err != nil {
+		log.Printf("Unable to save change queue: %v\n", err)
+	}
+}
+
+// replay uploads the queued changes that are due in order until they are
+// done or Drive becomes unreachable. The queue and sync state are saved
+// once for the whole batch.
+func (w *watcher) replay() {
+	if w.offline {
+		return
+	}
+	changes := w.queue.due(time.Now())
+	if len(changes) == 0 {
+		return
+	}
+	if err := w.checkLimits(changes); err != nil {
+		if msg := err.Error(); msg != w.limited {
+			fmt.Printf("Not replaying %d changes of %s: %v\n", len(changes), w.root, err)
+			w.limited = msg
+		}
+		return
+	}
+	w.limited = ""
+	for _, c := range changes {
+		err := w.upload(c.Path)
+		if err != nil && isOffline(err) {
+			w.goOffline(err)
+			break
+		}
+		if err != nil {
+			log.Printf("Error syncing %s, retrying in %s: %v\n", c.Path, w.queue.retry(c), err)
+			continue
+		}
+		w.queue.done(c)
+	}
+	if !w.offline {
+		if err := pushHardLinks(w.remote, w.state); err != nil {
+			log.Printf("Error uploading %s: %v\n", remoteLinksFile, err)
+		}
+	}
+	if err := w.state.save(); err != nil {
+		log.Printf("Unable to save sync state: %v\n", err)
+	}
+	if err := w.queue.save(); err != nil {
+		log.Printf("Unable to save change queue: %v\n", err)
+	}
+}
+
+// checkLimits applies the run limits to a batch of queued changes, measured
+// against the files seen by the last scan.
+func (w *watcher) checkLimits(changes []queuedChange) error {
+	if !limits.enabled() {
+		return nil
+	}
+	files := make([]File, 0, len(changes))
+	for _, c := range changes {
+		file := File{Name: filepath.FromSlash(c.Path), Path: filepath.Join(w.root, filepath.FromSlash(c.Path))}
+		if info, err := os.Stat(file.Path); err == nil {
+			file.Size = info.Size()
+		}
+		files = append(files, file)
+	}
+	plan, err := planUpload(files, len(w.stamps), w.state)
+	if err != nil {
+		return err
+	}
+	return limits.check(plan)
+}
+
+// upload syncs one local file, routed like syncFolder does.
+func (w *watcher) upload(rel string) error {
+	file := File{Name: filepath.FromSlash(rel), Path: filepath.Join(w.root, filepath.FromSlash(rel))}
+	if _, err := os.Stat(file.Path); os.IsNotExist(err) {
+		// Deleted again before it could be uploaded
+		return nil
+	}
+	if !secrets.allow(w.root, file) {
+		return nil
+	}
+	dir, skip, err := routeFile(w.rules, file)
+	if err != nil || skip {
+		return err
+	}
+	file.RemoteDir = dir
+	if len(claimRemotePaths([]File{file}, w.state)) == 0 {
+		return nil
+	}
+
+	uploaded, err := w.remote.upload(file.Path, file.remotePath())
+	if err != nil {
+		return err
+	}
+	w.state.set(rel, uploaded.stateEntry(uploaded.MD5))
+	w.state.setRoute(rel, file.remotePath())
+	if err := pushSidecar(w.remote, w.root, rel, uploaded); err != nil {
+		log.Printf("Error updating metadata of %s: %v\n", rel, err)
+	}
+	return nil
+}
+
+// goOffline starts probing for connectivity.
+func (w *watcher) goOffline(err error) {
+	if !w.offline {
+		fmt.Printf("Google Drive is unreachable (%v); queueing changes.\n", err)
+	}
+	w.offline = true
+	w.probeIn = time.Second
+	w.probeAt = time.Now().Add(w.probeIn)
+}
+
+// probe checks whether Drive is reachable again, doubling the interval to
+// the next probe up to maxProbe while it is not.
+func (w *watcher) probe() {
+	if !w.offline || time.Now().Before(w.probeAt) {
+		return
+	}
+	_, err := w.remote.service.About.Get().Fields("user(emailAddress)").Do()
+	if err != nil && isOffline(err) {
+		w.probeIn = min(2*w.probeIn, w.maxProbe)
+		w.probeAt = time.Now().Add(w.probeIn)
+		return
+	}
+	w.offline = false
+	w.remote.forgetFolders()
+	fmt.Printf("Google Drive is reachable again; replaying %d queued changes of %s.\n", w.queue.len(), w.root)
+}
+
+// runWatch keeps uploading local changes of every Google Drive sync pair
+// until interrupted.
+func runWatch(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := flags.Duration("interval", envDuration("GDRIVESYNC_WATCH_INTERVAL", 10*time.Second), "how often to scan the local folders")
+	force := flags.Bool("force", false, "proceed even if a batch of changes exceeds the safety limits")
+	flags.Parse(args)
+
+	limits = loadRunLimits(*force)
+
+	hashes = loadHashCache(hashCacheFile)
+	var err error
+	if secrets, err = newSecretScanner(); err != nil {
+		log.Fatalf("Unable to configure secret scanning: %v", err)
+	}
+	rules, err := loadRouteRules()
+	if err != nil {
+		log.Fatalf("Unable to load rules: %v", err)
+	}
+	if journal, err = openJournal(journalDir, "watch"); err != nil {
+		log.Fatalf("Unable to open journal: %v", err)
+	}
+	defer journal.close()
+
+	var service *drive.Service
+	var watchers []*watcher
+	for _, pair := range loadSyncPairs() {
+		rootID, err := pair.driveRoot()
+		if err != nil {
+			fmt.Printf("Not watching %s: %v\n", pair.Local, err)
+			continue
+		}
+		if service == nil {
+			service = newDriveService()
+		}
+		w := &watcher{
+			remote:   &driveBackend{service: service, rootID: rootID},
+			root:     pair.Local,
+			state:    loadSyncState(pair.stateFile()),
+			queue:    loadChangeQueue(pair.queueFile()),
+			rules:    rules,
+			maxProbe: envDuration("GDRIVESYNC_PROBE_MAX_INTERVAL", 5*time.Minute),
+		}
+		if n := w.queue.len(); n > 0 {
+			fmt.Printf("Replaying %d changes of %s queued by an earlier run.\n", n, w.root)
+		}
+		fmt.Printf("Watching %s.\n", w.root)
+		watchers = append(watchers, w)
+	}
+	if len(watchers) == 0 {
+		log.Fatal("No Google Drive sync pairs to watch")
+	}
+
+	fmt.Println("Press Ctrl+C to stop.")
+	for {
+		scanErrors.reset()
+		wait := *interval
+		for _, w := range watchers {
+			w.scan()
+			w.probe()
+			w.replay()
+
+			// Wake up early for a due probe while offline
+			if w.offline {
+				wait = min(wait, max(time.Until(w.probeAt), 0))
+			}
+		}
+		pruneHashCache()
+		if err := hashes.save(); err != nil {
+			log.Printf("Unable to save hash cache: %v\n", err)
+		}
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsOffline(t *testing.T) {
+	get := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://www.googleapis.com/drive/v3/about", Err: err}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", get(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), true},
+		{"name lookup", get(&net.DNSError{Err: "no such host", Name: "www.googleapis.com"}), true},
+		{"timeout", get(context.DeadlineExceeded), true},
+		{"revoked token", get(&oauth2.RetrieveError{ErrorCode: "invalid_grant"}), false},
+		{"forbidden", &googleapi.Error{Code: 403, Message: "insufficient permissions"}, false},
+		{"server error", fmt.Errorf("uploading: %w", &googleapi.Error{Code: 503}), false},
+		{"other client error", get(errors.New("stopped after 10 redirects")), false},
+		{"local error", errors.New("open notes.txt: permission denied"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isOffline(tt.err); got != tt.want {
+				t.Errorf("isOffline(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
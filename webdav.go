@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+// davFS exposes a Drive folder as a webdav.FileSystem. Reads are streamed
+// with ranged downloads, writes are spooled to a temporary file and
+// uploaded through uploadToGoogleDrive when the file is closed, and
+// deletions move items to the Drive trash.
+type davFS struct {
+	service *drive.Service
+	root    *drive.File
+}
+
+var _ webdav.FileSystem = (*davFS)(nil)
+
+// driveQueryString quotes a value for use in a Drive search query.
+func driveQueryString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// child looks up a non-trashed item by name inside a folder.
+func (d *davFS) child(parentID, name string) (*drive.File, error) {
+	query := fmt.Sprintf("name=%s and '%s' in parents and trashed=false", driveQueryString(name), parentID)
+	list, err := d.service.Files.List().Q(query).Fields("files(" + driveFileFields + ")").PageSize(1).Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Files) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return list.Files[0], nil
+}
+
+// resolve walks a slash separated path from the root folder.
+func (d *davFS) resolve(name string) (*drive.File, error) {
+	file := d.root
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if file.MimeType != folderMimeType {
+			return nil, os.ErrNotExist
+		}
+		next, err := d.child(file.Id, part)
+		if err != nil {
+			return nil, err
+		}
+		file = next
+	}
+	return file, nil
+}
+
+// resolveParent returns the folder that holds name and the base name.
+func (d *davFS) resolveParent(name string) (*drive.File, string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return nil, "", os.ErrInvalid
+	}
+	parent, err := d.resolve(path.Dir(clean))
+	if err != nil {
+		return nil, "", err
+	}
+	if parent.MimeType != folderMimeType {
+		return nil, "", os.ErrNotExist
+	}
+	return parent, path.Base(clean), nil
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	parent, base, err := d.resolveParent(name)
+	if err != nil {
+		return err
+	}
+	if _, err := d.child(parent.Id, base); err == nil {
+		return os.ErrExist
+	}
+	folder, err := d.service.Files.Create(&drive.File{Name: base, Parents: []string{parent.Id}, MimeType: folderMimeType}).Fields("id").Do()
+	if err != nil {
+		audit.record(actionCreate, name, "", "", err)
+		return err
+	}
+	audit.record(actionCreate, name, folder.Id, "", nil)
+	journal.record(journalEntry{Action: actionCreate, Path: name, DriveID: folder.Id})
+	return nil
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		parent, base, err := d.resolveParent(name)
+		if err != nil {
+			return nil, err
+		}
+		existing, err := d.child(parent.Id, base)
+		if err == nil && existing.MimeType == folderMimeType {
+			return nil, os.ErrExist
+		}
+		if err == nil && flag&os.O_EXCL != 0 {
+			return nil, os.ErrExist
+		}
+		if err != nil && flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+
+		// uploadToGoogleDrive names the Drive file after the local file
+		dir, err := os.MkdirTemp("", "gdrivesync-webdav-")
+		if err != nil {
+			return nil, err
+		}
+		tmp, err := os.Create(filepath.Join(dir, base))
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		return &davWriteFile{File: tmp, fs: d, name: name, parentID: parent.Id, dir: dir}, nil
+	}
+
+	file, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return &davReadFile{fs: d, file: file}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	if path.Clean("/"+name) == "/" {
+		return os.ErrPermission
+	}
+	file, err := d.resolve(name)
+	if err != nil {
+		return err
+	}
+	_, err = d.service.Files.Update(file.Id, &drive.File{Trashed: true}).Fields("id").Do()
+	audit.record(actionTrash, name, file.Id, file.Md5Checksum, err)
+	if err == nil {
+		journal.record(journalEntry{Action: actionTrash, Path: name, DriveID: file.Id})
+	}
+	return err
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	file, err := d.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	oldParent, _, err := d.resolveParent(oldName)
+	if err != nil {
+		return err
+	}
+	newParent, base, err := d.resolveParent(newName)
+	if err != nil {
+		return err
+	}
+
+	undo := journalEntry{Action: actionMove, Path: newName, DriveID: file.Id, OldName: file.Name}
+	call := d.service.Files.Update(file.Id, &drive.File{Name: base}).Fields("id")
+	if newParent.Id != oldParent.Id {
+		call = call.AddParents(newParent.Id).RemoveParents(oldParent.Id)
+		undo.OldParents, undo.NewParents = []string{oldParent.Id}, []string{newParent.Id}
+	}
+	_, err = call.Do()
+	audit.record(actionMove, oldName+" -> "+newName, file.Id, file.Md5Checksum, err)
+	if err == nil {
+		journal.record(undo)
+	}
+	return err
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	file, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return driveFileInfo{file}, nil
+}
+
+// driveFileInfo adapts a Drive file to os.FileInfo.
+type driveFileInfo struct {
+	file *drive.File
+}
+
+func (fi driveFileInfo) Name() string { return fi.file.Name }
+func (fi driveFileInfo) Size() int64  { return fi.file.Size }
+func (fi driveFileInfo) IsDir() bool  { return fi.file.MimeType == folderMimeType }
+func (fi driveFileInfo) Sys() any     { return fi.file }
+
+func (fi driveFileInfo) Mode() os.FileMode {
+	if fi.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi driveFileInfo) ModTime() time.Time {
+	modTime, _ := time.Parse(time.RFC3339, fi.file.ModifiedTime)
+	return modTime
+}
+
+// ContentType implements webdav.ContentTyper so files need not be sniffed.
+func (fi driveFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.file.MimeType == "" || fi.file.MimeType == "application/octet-stream" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.file.MimeType, nil
+}
+
+// ETag implements webdav.ETager using the Drive checksum.
+func (fi driveFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.file.Md5Checksum == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.file.Md5Checksum + `"`, nil
+}
+
+// davReadFile reads a Drive file or lists a Drive folder. File content is
+// fetched lazily from the current offset so seeking is free.
+type davReadFile struct {
+	fs     *davFS
+	file   *drive.File
+	offset int64
+	body   io.ReadCloser
+	listed bool
+}
+
+func (f *davReadFile) Stat() (fs.FileInfo, error) { return driveFileInfo{f.file}, nil }
+
+func (f *davReadFile) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func (f *davReadFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+func (f *davReadFile) Read(p []byte) (int, error) {
+	if f.file.MimeType == folderMimeType {
+		return 0, errors.New("is a directory")
+	}
+	if f.offset >= f.file.Size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		call := f.fs.service.Files.Get(f.file.Id)
+		call.Header().Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		resp, err := call.Download()
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *davReadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.file.Size
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *davReadFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if f.file.MimeType != folderMimeType {
+		return nil, errors.New("not a directory")
+	}
+	if f.listed {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	f.listed = true
+
+	var infos []fs.FileInfo
+	query := fmt.Sprintf("'%s' in parents and trashed=false", f.file.Id)
+	pageToken := ""
+	for {
+		list, err := f.fs.service.Files.List().Q(query).Fields("nextPageToken, files(" + driveFileFields + ")").PageToken(pageToken).PageSize(1000).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range list.Files {
+			infos = append(infos, driveFileInfo{child})
+		}
+		if list.NextPageToken == "" {
+			break
+		}
+		pageToken = list.NextPageToken
+	}
+	return infos, nil
+}
+
+// davWriteFile spools an upload to a temporary file.
+type davWriteFile struct {
+	*os.File
+	fs       *davFS
+	name     string
+	parentID string
+	dir      string
+}
+
+func (f *davWriteFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+// Close uploads the spooled content and removes the temporary file.
+func (f *davWriteFile) Close() error {
+	defer os.RemoveAll(f.dir)
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	_, err := uploadToGoogleDrive(f.fs.service, f.File.Name(), f.parentID)
+	if err != nil {
+		log.Printf("Error uploading %s: %v\n", f.name, err)
+	}
+	return err
+}
+
+// runServe implements the serve subcommands.
+func runServe(args []string) {
+	if len(args) == 0 || args[0] != "webdav" {
+		log.Fatal("Usage: gdrivesync serve webdav [-addr host:port] [-folder ID]")
+	}
+	flags := flag.NewFlagSet("serve webdav", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:8081", "address to listen on")
+	folderID := flags.String("folder", gDriveFolderID, "ID of the Drive folder to serve")
+	flags.Parse(args[1:])
+
+	// Uploads come from short-lived temporary files, so their checksums
+	// are not worth keeping in the persistent hash cache
+	hashes = &hashCache{entries: map[string]hashCacheEntry{}, seen: map[string]bool{}}
+
+	service := newDriveService()
+	var err error
+	if journal, err = openJournal(journalDir, "serve"); err != nil {
+		log.Fatalf("Unable to open journal: %v", err)
+	}
+	defer journal.close()
+
+	root, err := service.Files.Get(*folderID).Fields(driveFileFields).Do()
+	if err != nil {
+		log.Fatalf("Unable to find folder %s: %v", *folderID, err)
+	}
+	if root.MimeType != folderMimeType {
+		log.Fatalf("%s is not a folder", *folderID)
+	}
+
+	handler := &webdav.Handler{
+		FileSystem: &davFS{service: service, root: root},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("%s %s: %v\n", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	fmt.Printf("Serving %s over WebDAV on http://%s/\n", root.Name, *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// xattrPropertyPrefix prefixes the app properties holding xattrs.
+	xattrPropertyPrefix = "xattr."
+	// maxPropertyBytes is Drive's limit on key plus value of a property.
+	maxPropertyBytes = 124
+	// maxAppProperties is Drive's limit on app properties per file.
+	maxAppProperties = 30
+	// base64Marker prefixes values that are not valid UTF-8.
+	base64Marker = "b64:"
+)
+
+// xattrAllowlist returns the extended attributes to sync, from the comma
+// separated glob patterns in GDRIVESYNC_XATTRS, e.g. "user.checksum,user.origin*".
+// POSIX ACLs can be included as system.posix_acl_access when small enough
+// to fit a Drive property. Nothing is synced by default.
+func xattrAllowlist() []string {
+	return envList("GDRIVESYNC_XATTRS")
+}
+
+// xattrAllowed reports whether an attribute name matches the allowlist.
+func xattrAllowed(allowlist []string, name string) bool {
+	for _, pattern := range allowlist {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// xattrProperties reads the allowlisted extended attributes of a local file
+// and encodes them as Drive app properties. Attributes that do not fit
+// Drive's property size limits are skipped with a warning.
+func xattrProperties(localPath string) map[string]string {
+	allowlist := xattrAllowlist()
+	if len(allowlist) == 0 {
+		return nil
+	}
+	attrs, err := readXattrs(localPath)
+	if err != nil {
+		log.Printf("Unable to read extended attributes of %s: %v\n", localPath, err)
+		return nil
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		if xattrAllowed(allowlist, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	props := map[string]string{}
+	for _, name := range names {
+		key := xattrPropertyPrefix + name
+		value := string(attrs[name])
+		if !utf8.ValidString(value) || strings.ContainsRune(value, 0) {
+			value = base64Marker + base64.StdEncoding.EncodeToString(attrs[name])
+		}
+		if len(key)+len(value) > maxPropertyBytes {
+			log.Printf("Skipping extended attribute %s of %s: too large for a Drive property\n", name, localPath)
+			continue
+		}
+		if len(props) == maxAppProperties {
+			log.Printf("Skipping extended attribute %s of %s: too many attributes\n", name, localPath)
+			continue
+		}
+		props[key] = value
+	}
+	return props
+}
+
+// xattrPropertyChanges returns the app property updates that make the
+// xattr properties of a Drive file equal to want. Removed attributes map to
+// an empty value; attributes outside the allowlist are left alone.
+func xattrPropertyChanges(have, want map[string]string) map[string]string {
+	changes := map[string]string{}
+	for k, v := range want {
+		if have[k] != v {
+			changes[k] = v
+		}
+	}
+	allowlist := xattrAllowlist()
+	for k := range have {
+		name := strings.TrimPrefix(k, xattrPropertyPrefix)
+		if _, ok := want[k]; !ok && name != k && xattrAllowed(allowlist, name) {
+			changes[k] = ""
+		}
+	}
+	return changes
+}
+
+// appPropertiesPatch builds file metadata applying property changes, where
+// empty values delete the property. It returns nil if nothing changes.
+func appPropertiesPatch(changes map[string]string) *drive.File {
+	if len(changes) == 0 {
+		return nil
+	}
+	patch := &drive.File{AppProperties: map[string]string{}}
+	for k, v := range changes {
+		if v == "" {
+			patch.NullFields = append(patch.NullFields, "AppProperties."+k)
+		} else {
+			patch.AppProperties[k] = v
+		}
+	}
+	return patch
+}
+
+// restoreXattrs sets the allowlisted extended attributes stored in a Drive
+// file's app properties on the local file.
+func restoreXattrs(localPath string, props map[string]string) {
+	allowlist := xattrAllowlist()
+	if len(allowlist) == 0 {
+		return
+	}
+	for key, value := range props {
+		name := strings.TrimPrefix(key, xattrPropertyPrefix)
+		if name == key || !xattrAllowed(allowlist, name) {
+			continue
+		}
+		data := []byte(value)
+		if strings.HasPrefix(value, base64Marker) {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, base64Marker))
+			if err != nil {
+				log.Printf("Ignoring malformed extended attribute %s of %s\n", name, localPath)
+				continue
+			}
+			data = decoded
+		}
+		if err := writeXattr(localPath, name, data); err != nil {
+			log.Printf("Unable to set extended attribute %s on %s: %v\n", name, localPath, err)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// readXattrs reports no extended attributes on unsupported platforms.
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattr fails on platforms without extended attribute support.
+func writeXattr(path, name string, value []byte) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
@@ -0,0 +1,45 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns all extended attributes of a file.
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string][]byte{}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		n, err = unix.Getxattr(path, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value[:n]
+	}
+	return attrs, nil
+}
+
+// writeXattr sets an extended attribute on a file.
+func writeXattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}